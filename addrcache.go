@@ -0,0 +1,47 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// Maximum number of addresses kept in an addrCache.
+const addrCacheSize = 4096
+
+// addrCache maps raw socket addresses to net.Addr values.
+//
+// Converting the address of every received packet to a *net.UDPAddr
+// costs an allocation. Peers tend to send many packets, so we hand out
+// the same value for each of them. These values are shared and must
+// not be modified.
+type addrCache struct {
+	mu    sync.RWMutex
+	addrs map[netip.AddrPort]*net.UDPAddr
+}
+
+// get returns the address for the given socket address.
+func (ac *addrCache) get(ap netip.AddrPort) *net.UDPAddr {
+	ac.mu.RLock()
+	addr, ok := ac.addrs[ap]
+	ac.mu.RUnlock()
+
+	if ok {
+		return addr
+	}
+
+	addr = net.UDPAddrFromAddrPort(
+		netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()))
+
+	ac.mu.Lock()
+	if ac.addrs == nil || len(ac.addrs) >= addrCacheSize {
+		ac.addrs = make(map[netip.AddrPort]*net.UDPAddr)
+	}
+
+	ac.addrs[ap] = addr
+	ac.mu.Unlock()
+	return addr
+}
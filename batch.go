@@ -0,0 +1,106 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+// RecvBatch receives up to len(ps) packets. It blocks until at least one
+// packet is available and returns the number of packets filled in.
+//
+// Each packet is passed through the registered plugins, just as with Recv.
+// Packets which are discarded by a plugin or carry no payload data, are
+// returned with an empty Payload.
+//
+// Packets without a buffer borrow one from the connection. Call Release
+// on them once they are no longer needed. Packets which already hold a
+// buffer, are reused as is. This allows the same slice of packets to be
+// passed to subsequent calls without allocating any buffers. The source
+// address of each packet is still allocated by the system call wrapper.
+//
+// On Linux this reads all packets with a single system call.
+// Other platforms receive a single packet per call.
+func (c *Connection) RecvBatch(ps []Packet) (int, error) {
+	s := c.socket()
+
+	if s == nil {
+		return 0, ErrConnectionectionClosed
+	}
+
+	if len(ps) == 0 {
+		return 0, nil
+	}
+
+	for i := range ps {
+		if ps[i].buf == nil {
+			ps[i].buf = c.buffers.Get().(*[]byte)
+			ps[i].conn = c
+		}
+	}
+
+	if s.batch == nil {
+		return c.recvBatchLoop(ps)
+	}
+
+	return c.recvBatch(s, ps)
+}
+
+// SendBatch sends the payload of each given packet to its address.
+// It returns the number of packets which have been sent.
+//
+// Each packet is passed through the registered plugins, just as with Send.
+//
+// On Linux this writes all packets with as few system calls as possible,
+// without allocating. Other platforms send one packet at a time.
+func (c *Connection) SendBatch(ps []Packet) (int, error) {
+	s := c.socket()
+
+	if s == nil {
+		return 0, ErrConnectionectionClosed
+	}
+
+	size := c.PayloadSize()
+
+	for i := range ps {
+		if len(ps[i].Payload) > size {
+			return 0, ErrPacketSize
+		}
+
+		addr, err := s.target(ps[i].Addr)
+
+		if err != nil {
+			return 0, err
+		}
+
+		ps[i].Addr = addr
+	}
+
+	if s.batch == nil {
+		return c.sendBatchLoop(ps)
+	}
+
+	return c.sendBatch(s, ps)
+}
+
+// recvBatchLoop is the portable version of RecvBatch.
+// It receives a single packet.
+func (c *Connection) recvBatchLoop(ps []Packet) (int, error) {
+	err := c.recvPacket(&ps[0])
+
+	if err != nil {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+// sendBatchLoop is the portable version of SendBatch.
+func (c *Connection) sendBatchLoop(ps []Packet) (int, error) {
+	for i := range ps {
+		err := c.Send(ps[i].Addr, ps[i].Payload)
+
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(ps), nil
+}
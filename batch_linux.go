@@ -0,0 +1,167 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+)
+
+// batchConn reads and writes multiple packets per system call,
+// using recvmmsg(2) and sendmmsg(2).
+//
+// ipv4.Message and ipv6.Message are the same type, so both
+// ipv4.PacketConn and ipv6.PacketConn satisfy this interface.
+type batchConn interface {
+	ReadBatch([]ipv4.Message, int) (int, error)
+	WriteBatch([]ipv4.Message, int) (int, error)
+}
+
+// newBatchConn returns a batchConn for the given socket.
+// Returns nil if the socket does not support batched I/O.
+func newBatchConn(pc net.PacketConn) batchConn {
+	uc, ok := pc.(*net.UDPConn)
+
+	if !ok {
+		return nil
+	}
+
+	ua, ok := uc.LocalAddr().(*net.UDPAddr)
+
+	if !ok {
+		return nil
+	}
+
+	if ua.IP.To4() != nil {
+		return ipv4.NewPacketConn(uc)
+	}
+
+	return ipv6.NewPacketConn(uc)
+}
+
+// batch holds the messages of a single batched read or write.
+type batch struct {
+	ms   []ipv4.Message
+	bufs [][]byte  // The Buffers of each message are slices of this.
+	out  []*[]byte // Packet buffers borrowed by sendBatch.
+}
+
+// getBatch returns a batch of n messages from the socket's pool.
+func (s *socket) getBatch(n int) *batch {
+	b, _ := s.msgs.Get().(*batch)
+
+	if b == nil {
+		b = new(batch)
+	}
+
+	if cap(b.ms) < n {
+		b.ms = make([]ipv4.Message, n)
+		b.bufs = make([][]byte, n)
+		b.out = make([]*[]byte, n)
+	}
+
+	b.ms = b.ms[:n]
+	b.bufs = b.bufs[:n]
+	b.out = b.out[:n]
+
+	for i := range b.ms {
+		b.ms[i].Buffers = b.bufs[i : i+1 : i+1]
+	}
+
+	return b
+}
+
+// putBatch returns the packet buffers borrowed by b to the connection,
+// and b to the socket's pool.
+func (c *Connection) putBatch(s *socket, b *batch) {
+	for _, buf := range b.out {
+		if buf != nil {
+			c.buffers.Put(buf)
+		}
+	}
+
+	clear(b.ms)
+	clear(b.bufs)
+	clear(b.out)
+	s.msgs.Put(b)
+}
+
+// recvBatch reads multiple packets with a single system call.
+func (c *Connection) recvBatch(s *socket, ps []Packet) (int, error) {
+	b := s.getBatch(len(ps))
+	defer c.putBatch(s, b)
+
+	ms := b.ms
+
+	for i := range ps {
+		b.bufs[i] = *ps[i].buf
+	}
+
+	n, err := s.batch.ReadBatch(ms, 0)
+
+	for err != nil && s.rd.retry(err, nil) {
+		n, err = s.batch.ReadBatch(ms, 0)
+	}
+
+	if err != nil {
+		return 0, closedError(err)
+	}
+
+	for i := 0; i < n; i++ {
+		p := &ps[i]
+		p.Addr = ms[i].Addr
+
+		if ua, ok := p.Addr.(*net.UDPAddr); ok {
+			p.Addr = c.addrs.get(ua.AddrPort())
+		}
+
+		p.Payload, err = c.process(s, p.Addr, (*p.buf)[:ms[i].N], nil)
+
+		// The other packets have already been read. A plugin error only
+		// affects this one, so it is treated as discarded.
+		if err != nil {
+			p.Payload = nil
+		}
+	}
+
+	return n, nil
+}
+
+// sendBatch writes multiple packets with as few system calls as possible.
+func (c *Connection) sendBatch(s *socket, ps []Packet) (int, error) {
+	b := s.getBatch(len(ps))
+	defer c.putBatch(s, b)
+
+	ms := b.ms
+
+	for i := range ps {
+		b.out[i] = c.buffers.Get().(*[]byte)
+
+		packet, err := c.build(s, *b.out[i], ps[i].Addr, ps[i].Payload, false)
+
+		if err != nil {
+			return 0, err
+		}
+
+		b.bufs[i] = packet
+
+		if s.raddr == nil {
+			ms[i].Addr = ps[i].Addr
+		}
+	}
+
+	var sent int
+
+	for sent < len(ms) {
+		n, err := s.batch.WriteBatch(ms[sent:], 0)
+		sent += n
+
+		if err != nil && !s.wd.retry(err, nil) {
+			return sent, closedError(err)
+		}
+	}
+
+	return sent, nil
+}
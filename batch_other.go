@@ -0,0 +1,20 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+//go:build !linux
+
+package xudp
+
+import "net"
+
+// batchConn is not supported on this platform.
+// RecvBatch and SendBatch fall back to a loop.
+type batchConn interface {
+	unsupported()
+}
+
+// newBatchConn always returns nil on this platform.
+func newBatchConn(pc net.PacketConn) batchConn { return nil }
+
+func (c *Connection) recvBatch(s *socket, ps []Packet) (int, error) { return c.recvBatchLoop(ps) }
+func (c *Connection) sendBatch(s *socket, ps []Packet) (int, error) { return c.sendBatchLoop(ps) }
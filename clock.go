@@ -0,0 +1,49 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import "time"
+
+// A Clock tells the time and schedules calls for later. A connection uses
+// it to tick plugins which implement Ticker and to evict idle peers.
+//
+// The default clock is the system clock. Tests can substitute their own,
+// to control the passing of time.
+type Clock interface {
+	// Returns the current time.
+	Now() time.Time
+
+	// Calls f once the given duration has elapsed. Like time.AfterFunc,
+	// it must return before f is called.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a call scheduled by a Clock.
+type Timer interface {
+	// Prevents the call from happening. Returns false if the call has
+	// already happened or the timer was stopped before.
+	Stop() bool
+}
+
+// systemClock is the Clock used by default.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// SetClock sets the clock which drives tickers and peer eviction. A nil
+// clock selects the system clock, which is the default. It takes effect
+// the next time the connection is opened.
+func (c *Connection) SetClock(clk Clock) {
+	if clk == nil {
+		clk = systemClock{}
+	}
+
+	c.mu.Lock()
+	c.clock = clk
+	c.mu.Unlock()
+}
@@ -7,6 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,21 +26,64 @@ var (
 	ErrPacketSize             = errors.New("Packet size exceeds MTU.")
 	ErrShortWrite             = errors.New("Short write: Send was incomplete.")
 	ErrDiscard                = errors.New("Packet is not meant for us.")
+	ErrNotConnected           = errors.New("Connection has no remote address.")
+	ErrRemoteAddr             = errors.New("Address does not match the remote address.")
+	ErrHeaderSize             = errors.New("Plugin header size exceeds its PayloadSize.")
+	ErrStage                  = errors.New("Plugin has an invalid stage.")
+	ErrQueueFull              = errors.New("Control packet queue is full.")
 )
 
 // A connection allows two-way communication with an end point.
 //
 // Without any registered plugins, this is really nothing more than
-// a wrapper around the standard Go UDP connection tools. 
+// a wrapper around the standard Go UDP connection tools.
 //
 // The plugins you can add, give it added complexity and usefulness
 // in a way specific to your application. By using the stackable
 // building block approach, you are never stuck with a connection that
 // does more than you need it to do.
+//
+// A connection is safe for concurrent use by multiple goroutines.
+// Send and Recv may be called concurrently, as may Register, Unregister
+// and SetPlugins while packets are in flight. Each packet is processed by
+// the list of plugins registered at the time it is sent or received.
+// Close interrupts pending Send and Recv calls and waits for packets
+// which are being processed by plugins, before closing the plugins.
+//
+// Plugins are called from whichever goroutine sends or receives a packet.
+// When a connection is used from multiple goroutines, its plugins must be
+// safe for concurrent use as well. Plugin callbacks must not call Close
+// on the connection which invoked them.
 type Connection struct {
-	PluginList
-	udp net.PacketConn // Underlying socket.
-	mtu uint32         // maximum packet size.
+	mtu       uint32       // maximum packet size.
+	buffers   sync.Pool    // Packet buffers of mtu-UDPHeaderSize bytes.
+	addrs     addrCache    // Addresses of recently seen peers.
+	dropped   atomic.Int64 // Packets dropped by Incoming and sessions.
+	peers     peerTable    // Plugin state for each peer.
+	mu        sync.RWMutex // Guards the fields below.
+	plugins   PluginList   // Registered plugins. Copied on write.
+	sock      *socket      // Underlying socket; nil if closed.
+	keepOpen  bool         // Leave the socket open when the connection closes.
+	readers   int          // Number of goroutines used by Serve.
+	clock     Clock        // Drives tickers and peer eviction.
+	rdeadline time.Time    // Read deadline set by the host.
+	wdeadline time.Time    // Write deadline set by the host.
+}
+
+// socket holds the state of an open connection.
+// Its fields do not change while the connection is open.
+type socket struct {
+	pc     net.PacketConn // Underlying socket.
+	batch  batchConn      // Batched I/O on pc; nil if unsupported.
+	raddr  net.Addr       // Remote address for dialed connections.
+	port   int            // Local port number.
+	busy   sync.WaitGroup // Packets being processed by plugins.
+	closed chan struct{}  // Closed when the connection closes.
+	inject chan injected  // Control packets waiting to be sent.
+	sched  *scheduler     // Ticks plugins while the connection is open.
+	msgs   sync.Pool      // Messages for batched I/O, reused across calls.
+	rd     interrupter    // Read deadline of pc.
+	wd     interrupter    // Write deadline of pc.
 }
 
 // New creates a new connection.
@@ -47,159 +93,690 @@ type Connection struct {
 //
 // Some commonly used values are as follows:
 //
-//     1500 - The largest Ethernet packet size. This is the typical setting for
-//            non-PPPoE, non-VPN connections. The default value for NETGEAR
-//            routers, adapters and switches.
-//     1492 - The size PPPoE prefers.
-//     1472 - Maximum size to use for pinging (Bigger packets are fragmented).
-//     1468 - The size DHCP prefers.
-//     1460 - Usable by AOL if you don't have large email attachments, etc.
-//     1430 - The size VPN and PPTP prefer.
-//     1400 - Maximum size for AOL DSL.
-//      576 - Typical value to connect to dial-up ISPs.
+//	1500 - The largest Ethernet packet size. This is the typical setting for
+//	       non-PPPoE, non-VPN connections. The default value for NETGEAR
+//	       routers, adapters and switches.
+//	1492 - The size PPPoE prefers.
+//	1472 - Maximum size to use for pinging (Bigger packets are fragmented).
+//	1468 - The size DHCP prefers.
+//	1460 - Usable by AOL if you don't have large email attachments, etc.
+//	1430 - The size VPN and PPTP prefer.
+//	1400 - Maximum size for AOL DSL.
+//	 576 - Typical value to connect to dial-up ISPs.
 func New(mtu uint32) *Connection {
 	c := new(Connection)
 	c.mtu = mtu
+	c.clock = systemClock{}
+	c.peers.timeout = DefaultPeerTimeout
+	c.peers.clock = c.clock
+	c.buffers.New = func() interface{} {
+		b := make([]byte, mtu-UDPHeaderSize)
+		return &b
+	}
 	return c
 }
 
 // PayloadSize returns the maximum size in bytes for a single packet payload.
-// This is the MTU minus the UDP header and the space required by all
-// registered plugins.
+// This is the MTU minus the UDP header and the space required by the
+// headers, trailers and transformer overhead of all registered plugins,
+// as well as the flag byte which marks control packets, if needed.
 func (c *Connection) PayloadSize() int {
-	size := int(c.mtu) - UDPHeaderSize
+	pl := c.Plugins()
+	return c.payloadSize(pl, pl.PayloadSize())
+}
+
+// payloadSize returns the maximum payload size for the given plugins,
+// whose headers take up the given number of bytes.
+func (c *Connection) payloadSize(pl PluginList, header int) int {
+	return int(c.mtu) - UDPHeaderSize - header - pl.TrailerSize() -
+		pl.Overhead() - pl.controlSize()
+}
+
+// Plugins returns a copy of the list of registered plugins.
+func (c *Connection) Plugins() PluginList {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append(PluginList(nil), c.plugins...)
+}
+
+// Contains returns true if the given plugin is registered.
+func (c *Connection) Contains(p Plugin) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.plugins.Contains(p)
+}
+
+// Register registers the given plugin.
+//
+// The plugin is placed after all plugins of the same or an earlier stage.
+// Returns ErrStage if the plugin's stage is not valid.
+//
+// If the connection is open, the plugin is opened as well. It is not
+// registered if this fails. A Controller is handed the connection's
+// injector once it has been registered.
+func (c *Connection) Register(p Plugin) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.plugins.Contains(p) {
+		return nil
+	}
+
+	if !StageOf(p).Valid() {
+		return ErrStage
+	}
+
+	if c.sock != nil {
+		err := p.Open(c.sock.port)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	pl := append(PluginList(nil), c.plugins...)
+	pl.Register(p)
+	c.plugins = pl
+	setInjector(p, c)
+
+	if c.sock != nil {
+		c.sock.sched.kick()
+	}
+
+	return nil
+}
+
+// Unregister removes the given plugin from the connection.
+//
+// If the connection is open, the plugin is closed. Packets which were
+// already being processed at this time, may still reach the plugin.
+func (c *Connection) Unregister(p Plugin) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.plugins.Contains(p) {
+		return nil
+	}
+
+	pl := append(PluginList(nil), c.plugins...)
+	pl.Unregister(p)
+	c.plugins = pl
+	setInjector(p, nil)
+
+	if c.sock != nil {
+		return p.Close()
+	}
+
+	return nil
+}
+
+// SetPlugins replaces all registered plugins with the given list in a
+// single step. Subsequent packets are processed by the new list.
+// The plugins are ordered by stage, just as with Register. Returns
+// ErrStage if any plugin's stage is not valid.
+//
+// If the connection is open, plugins which were not registered yet are
+// opened and plugins which are no longer in the list are closed. If any
+// of the new plugins fails to open, the list is left unchanged.
+func (c *Connection) SetPlugins(list PluginList) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var pl PluginList
+	for _, plg := range list {
+		if !StageOf(plg).Valid() {
+			return ErrStage
+		}
+
+		pl.Register(plg)
+	}
+
+	if c.sock != nil {
+		for i, plg := range pl {
+			if c.plugins.Contains(plg) {
+				continue
+			}
+
+			err := plg.Open(c.sock.port)
+
+			if err == nil {
+				continue
+			}
+
+			for _, opened := range pl[:i] {
+				if !c.plugins.Contains(opened) {
+					opened.Close()
+				}
+			}
+
+			return err
+		}
+
+		for _, plg := range c.plugins {
+			if !pl.Contains(plg) {
+				plg.Close()
+			}
+		}
+	}
+
+	for _, plg := range c.plugins {
+		if !pl.Contains(plg) {
+			setInjector(plg, nil)
+		}
+	}
+
+	for _, plg := range pl {
+		if !c.plugins.Contains(plg) {
+			setInjector(plg, c)
+		}
+	}
 
-	for _, plg := range c.PluginList {
-		size -= plg.PayloadSize()
+	c.plugins = pl
+
+	if c.sock != nil {
+		c.sock.sched.kick()
 	}
 
-	return size
+	return nil
 }
 
 // Open opens the connection on the given port number.
-func (c *Connection) Open(port int) (err error) {
-	if c.udp != nil {
+// It listens on all available interfaces. This is equivalent to:
+//
+//	c.OpenAddr("udp", fmt.Sprintf(":%d", port))
+func (c *Connection) Open(port int) error {
+	return c.OpenAddr("udp", fmt.Sprintf(":%d", port))
+}
+
+// OpenAddr opens the connection on the given local address.
+//
+// The network must be "udp", "udp4" or "udp6". The latter two restrict
+// the connection to IPv4 or IPv6 respectively. The address has the form
+// "host:port". The host may be omitted to listen on all interfaces, or
+// name the IP address of a specific interface. A zero port picks an
+// available port. Use LocalAddr to find out which one was chosen.
+//
+// Each registered plugin is passed the port the connection is bound to.
+func (c *Connection) OpenAddr(network, laddr string) (err error) {
+	if c.socket() != nil {
 		return ErrConnectionectionOpen
 	}
 
-	c.udp, err = net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return net.UnknownNetworkError(network)
+	}
+
+	pc, err := net.ListenPacket(network, laddr)
 
 	if err != nil {
 		return
 	}
 
-	zero := time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC)
-	c.udp.SetReadDeadline(zero)
-	c.udp.SetWriteDeadline(zero)
+	err = c.open(pc, nil)
 
-	for _, plg := range c.PluginList {
-		err = plg.Open(port)
+	if err != nil {
+		pc.Close()
+	}
 
-		if err != nil {
-			c.Close()
-			return
+	return
+}
+
+// open starts using the given socket and opens all plugins.
+// Each plugin is passed the local port the socket is bound to.
+//
+// The given remote address is set for dialed connections.
+func (c *Connection) open(pc net.PacketConn, raddr net.Addr) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sock != nil {
+		return ErrConnectionectionOpen
+	}
+
+	s := &socket{
+		pc:     pc,
+		raddr:  raddr,
+		closed: make(chan struct{}),
+		inject: make(chan injected, injectBacklog),
+	}
+
+	s.batch = newBatchConn(pc)
+	s.sched = newScheduler(c, s, c.clock)
+
+	if ua, ok := pc.LocalAddr().(*net.UDPAddr); ok {
+		s.port = ua.Port
+	}
+
+	s.rd.set = pc.SetReadDeadline
+	s.wd.set = pc.SetWriteDeadline
+	s.rd.setHost(c.rdeadline)
+	s.wd.setHost(c.wdeadline)
+
+	for i, plg := range c.plugins {
+		err = plg.Open(s.port)
+
+		if err == nil {
+			continue
+		}
+
+		for _, opened := range c.plugins[:i] {
+			opened.Close()
 		}
+
+		return
 	}
 
+	c.peers.mu.Lock()
+	c.peers.clock = c.clock
+	c.peers.mu.Unlock()
+
+	c.sock = s
+	go c.sendInjected(s)
+	s.sched.kick()
 	return
 }
 
+// socket returns the underlying socket, or nil if the connection is closed.
+func (c *Connection) socket() *socket {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sock
+}
+
+// acquire marks a packet as being processed on the given socket and
+// returns the plugins to process it with. Returns false if the
+// connection has been closed or reopened in the mean time.
+//
+// Each successful call must be followed by a call to s.busy.Done.
+func (c *Connection) acquire(s *socket) (PluginList, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.sock != s || s == nil {
+		return nil, false
+	}
+
+	s.busy.Add(1)
+	return c.plugins, true
+}
+
+// LocalAddr returns the local network address.
+// Returns nil if the connection is not open.
+func (c *Connection) LocalAddr() net.Addr {
+	s := c.socket()
+
+	if s == nil {
+		return nil
+	}
+
+	return s.pc.LocalAddr()
+}
+
 // Close closes the connection.
+//
+// The underlying socket is closed as well, unless SetKeepOpen has been
+// used to leave it open.
+//
+// The state plugins keep for each peer is released. All plugins are then
+// closed and unregistered.
 func (c *Connection) Close() (err error) {
-	if c.udp == nil {
+	c.mu.Lock()
+	s := c.sock
+	pl := c.plugins
+	keep := c.keepOpen
+	c.sock = nil
+	c.plugins = nil
+	c.mu.Unlock()
+
+	if s == nil {
 		return ErrConnectionectionClosed
 	}
 
-	err = c.udp.Close()
-	c.udp = nil
+	close(s.closed)
+	s.sched.stop()
+
+	if !keep {
+		err = s.pc.Close()
+	}
+
+	s.busy.Wait()
+	c.peers.clear()
 
-	for _, plg := range c.PluginList {
+	for _, plg := range pl {
 		plg.Close()
+		setInjector(plg, nil)
 	}
 
-	c.PluginList.Clear()
-	c.PluginList = nil
 	return
 }
 
-// Send sends the given payload to the specified destination.
-func (c *Connection) Send(addr net.Addr, payload []byte) (err error) {
-	if c.udp == nil {
-		return ErrConnectionectionClosed
+// SetDeadline sets the read and write deadlines for the connection.
+// It is equivalent to calling both SetReadDeadline and SetWriteDeadline.
+func (c *Connection) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+
+	if err != nil {
+		return err
 	}
 
-	if len(payload) > c.PayloadSize() {
-		return ErrPacketSize
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future Recv calls and any
+// currently blocked Recv call. A zero value for t means Recv will not
+// time out. A Recv which exceeds the deadline returns a net.Error
+// for which Timeout() returns true.
+//
+// Deadlines set before the connection is opened, are applied when
+// it is opened.
+func (c *Connection) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.rdeadline = t
+
+	if c.sock == nil {
+		return nil
 	}
 
-	var index int
+	return c.sock.rd.setHost(t)
+}
 
-	b := make([]byte, c.mtu-UDPHeaderSize)
-	header := c.PluginList.PayloadSize()
-	total := header + len(payload)
+// SetWriteDeadline sets the deadline for future Send calls and any
+// currently blocked Send call. A zero value for t means Send will not
+// time out.
+func (c *Connection) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	copy(b[header:], payload)
+	c.wdeadline = t
 
-	for _, plg := range c.PluginList {
-		err = plg.Send(addr, b[index:total], header)
+	if c.sock == nil {
+		return nil
+	}
 
-		if err != nil {
-			return
-		}
+	return c.sock.wd.setHost(t)
+}
 
-		index += plg.PayloadSize()
+// Send sends the given payload to the specified destination.
+//
+// A dialed connection only sends to its remote address.
+// For these, addr may be nil.
+func (c *Connection) Send(addr net.Addr, payload []byte) error {
+	s := c.socket()
+
+	if s == nil {
+		return ErrConnectionectionClosed
 	}
 
-	size, err := c.udp.WriteTo(b[:total], addr)
+	return c.send(s, addr, payload, nil)
+}
+
+// send builds a packet and writes it to the socket. The given channel
+// is closed if the write should be interrupted. See interrupter.
+func (c *Connection) send(s *socket, addr net.Addr, payload []byte, cancel <-chan struct{}) (err error) {
+	addr, err = s.target(addr)
 	if err != nil {
 		return
 	}
 
-	if size < total {
+	buf := c.buffers.Get().(*[]byte)
+	defer c.buffers.Put(buf)
+
+	b, err := c.build(s, *buf, addr, payload, false)
+	if err != nil {
+		return
+	}
+
+	size, err := s.writeTo(b, addr, cancel)
+	if err != nil {
+		return closedError(err)
+	}
+
+	if size < len(b) {
 		err = ErrShortWrite
 	}
 
 	return
 }
 
+// target returns the address to send a packet to.
+// For dialed connections, this is always the remote address.
+func (s *socket) target(addr net.Addr) (net.Addr, error) {
+	if s.raddr == nil {
+		return addr, nil
+	}
+
+	if addr != nil && !sameAddr(addr, s.raddr) {
+		return nil, ErrRemoteAddr
+	}
+
+	return s.raddr, nil
+}
+
+// build assembles an outgoing packet in buf and runs it through all plugins.
+// It returns the portion of buf which should be written to the socket.
+// The packet is marked as a control packet if control is true.
+func (c *Connection) build(s *socket, buf []byte, addr net.Addr, payload []byte, control bool) ([]byte, error) {
+	pl, ok := c.acquire(s)
+
+	if !ok {
+		return nil, ErrConnectionectionClosed
+	}
+
+	defer s.busy.Done()
+
+	var space [16]int
+	sizes, header := pl.headerSizes(space[:0])
+
+	if len(payload) > c.payloadSize(pl, header) {
+		return nil, ErrPacketSize
+	}
+
+	inner := header + pl.controlSize()
+	total := inner + len(payload)
+
+	copy(buf[inner:], payload)
+
+	if inner > header {
+		buf[header] = flagData
+
+		if control {
+			buf[header] = flagControl
+		}
+	}
+
+	ps := pass{conn: c, addr: addr}
+	defer ps.release()
+
+	start, end, err := pl.send(&ps, buf, sizes, header, inner, total)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[start:end], nil
+}
+
 // Recv receives a new payload. This is a blocking operation.
+//
+// The returned payload is a copy which the caller owns. Use RecvInto or
+// RecvPacket to receive without allocating.
 func (c *Connection) Recv() (addr net.Addr, payload []byte, err error) {
-	if c.udp == nil {
+	s := c.socket()
+
+	if s == nil {
 		return nil, nil, ErrConnectionectionClosed
 	}
 
-	b := make([]byte, c.mtu-UDPHeaderSize)
-	size, addr, err := c.udp.ReadFrom(b[:])
+	return c.recvCopy(s, nil)
+}
 
-	if err != nil {
+// recvCopy receives a packet and returns a copy of its payload. The given
+// channel is closed if the read should be interrupted. See interrupter.
+func (c *Connection) recvCopy(s *socket, cancel <-chan struct{}) (addr net.Addr, payload []byte, err error) {
+	buf := c.buffers.Get().(*[]byte)
+	defer c.buffers.Put(buf)
+
+	addr, data, err := c.recv(s, *buf, cancel)
+
+	if err != nil || len(data) == 0 {
 		return
 	}
 
-	header := c.PluginList.PayloadSize()
-	if size < header {
-		return // Not enough data.
+	payload = make([]byte, len(data))
+	copy(payload, data)
+	return
+}
+
+// recv reads a single packet into b and runs it through all plugins.
+// The returned payload is a slice of b.
+func (c *Connection) recv(s *socket, b []byte, cancel <-chan struct{}) (addr net.Addr, payload []byte, err error) {
+	size, addr, err := c.readFrom(s, b, cancel)
+
+	if err != nil {
+		return nil, nil, closedError(err)
 	}
 
-	var packetSize int
-	for _, plg := range c.PluginList {
-		err = plg.Recv(addr, b[packetSize:size], header)
+	payload, err = c.process(s, addr, b[:size], nil)
+	return
+}
 
-		if err != nil {
-			if err == ErrDiscard {
-				err = nil // No need to propagate this.
-			}
-			return
+// process runs a received packet through all plugins.
+// It returns the payload portion of b, if there is any. Control packets
+// yield no payload. If key is not nil, it receives the peer key reported
+// by a Keyer.
+func (c *Connection) process(s *socket, addr net.Addr, b []byte, key *string) (payload []byte, err error) {
+	pl, ok := c.acquire(s)
+
+	if !ok {
+		return nil, ErrConnectionectionClosed
+	}
+
+	defer s.busy.Done()
+
+	ps := pass{conn: c, addr: addr, key: key}
+	defer ps.release()
+
+	start, end, err := pl.recv(&ps, b)
+
+	if err != nil {
+		if err == ErrDiscard {
+			err = nil // No need to propagate this.
+		}
+		return
+	}
+
+	if pl.controlSize() > 0 {
+		if start == end || b[start] != flagData {
+			return // Control packet.
 		}
 
-		packetSize += plg.PayloadSize()
+		start++
 	}
 
-	size -= packetSize
-	if size <= 0 {
+	if start == end {
 		return // No payload data.
 	}
 
-	payload = make([]byte, size)
-	copy(payload, b[packetSize:packetSize+size])
+	payload = b[start:end]
 	return
 }
+
+// readFrom reads a single datagram into b. Reads which are interrupted
+// on behalf of another caller, are retried. The given channel is closed
+// if this read should be interrupted.
+//
+// For UDP sockets, the source address is taken from a cache, so
+// repeated reads from the same peer do not allocate.
+func (c *Connection) readFrom(s *socket, b []byte, cancel <-chan struct{}) (int, net.Addr, error) {
+	for {
+		size, addr, err := c.readOnce(s, b)
+
+		if err == nil || !s.rd.retry(err, cancel) {
+			return size, addr, err
+		}
+	}
+}
+
+// readOnce reads a single datagram into b.
+func (c *Connection) readOnce(s *socket, b []byte) (int, net.Addr, error) {
+	uc, ok := s.pc.(*net.UDPConn)
+
+	if !ok {
+		return s.pc.ReadFrom(b)
+	}
+
+	size, ap, err := uc.ReadFromUDPAddrPort(b)
+
+	if err != nil {
+		return size, nil, err
+	}
+
+	return size, c.addrs.get(ap), nil
+}
+
+// writeTo writes a single datagram to the given address. Writes which
+// are interrupted on behalf of another caller, are retried. The given
+// channel is closed if this write should be interrupted.
+func (s *socket) writeTo(b []byte, addr net.Addr, cancel <-chan struct{}) (int, error) {
+	for {
+		size, err := s.writeOnce(b, addr)
+
+		if err == nil || !s.wd.retry(err, cancel) {
+			return size, err
+		}
+	}
+}
+
+// writeOnce writes a single datagram to the given address.
+func (s *socket) writeOnce(b []byte, addr net.Addr) (int, error) {
+	uc, ok := s.pc.(*net.UDPConn)
+
+	if !ok {
+		return s.pc.WriteTo(b, addr)
+	}
+
+	if s.raddr != nil {
+		return uc.Write(b)
+	}
+
+	ua, ok := addr.(*net.UDPAddr)
+
+	if !ok {
+		return s.pc.WriteTo(b, addr)
+	}
+
+	ap := ua.AddrPort()
+
+	if !ap.Addr().IsValid() {
+		// Unspecified address. Let the net package pick the local host.
+		return s.pc.WriteTo(b, addr)
+	}
+
+	return uc.WriteToUDPAddrPort(b, netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()))
+}
+
+// closedError translates errors caused by a closed socket into
+// ErrConnectionectionClosed.
+func closedError(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return ErrConnectionectionClosed
+	}
+
+	return err
+}
+
+// sameAddr returns true if a and b denote the same end point.
+func sameAddr(a, b net.Addr) bool {
+	ua, ok := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+
+	if ok && ok2 {
+		return ua.Port == ub.Port && ua.IP.Equal(ub.IP) && ua.Zone == ub.Zone
+	}
+
+	return a.Network() == b.Network() && a.String() == b.String()
+}
@@ -4,7 +4,16 @@
 package xudp
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -26,6 +35,1593 @@ func TestConn(t *testing.T) {
 	<-time.After(time.Second / 2)
 }
 
+func TestRecvContext(t *testing.T) {
+	c := initConn(t, 12347)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/10)
+	defer cancel()
+
+	_, _, err := c.RecvContext(ctx)
+
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Expected timeout error, have %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		<-time.After(time.Second / 10)
+		cancel()
+	}()
+
+	_, _, err = c.RecvContext(ctx)
+
+	if err == nil || err.(net.Error).Timeout() {
+		t.Fatalf("Expected cancellation error, have %v", err)
+	}
+}
+
+// TestRecvContextShared checks that a context only interrupts the call it
+// was passed to, and not other calls which receive at the same time.
+func TestRecvContextShared(t *testing.T) {
+	c := initConn(t, 12366)
+	defer c.Close()
+
+	type result struct {
+		payload []byte
+		err     error
+	}
+
+	recv := make(chan result, 1)
+
+	go func() {
+		_, payload, err := c.Recv()
+		recv <- result{payload, err}
+	}()
+
+	// Let Recv block first.
+	time.Sleep(time.Second / 20)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/20)
+	defer cancel()
+
+	_, _, err := c.RecvContext(ctx)
+
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Expected timeout error, have %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second/20)
+	defer cancel()
+
+	err = c.Serve(ctx, func(net.Addr, []byte) {})
+
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Expected timeout error, have %v", err)
+	}
+
+	select {
+	case r := <-recv:
+		t.Fatalf("Concurrent Recv was interrupted: %q, %v", r.payload, r.err)
+	case <-time.After(time.Second / 20):
+	}
+
+	c.Send(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12366}, Payload)
+
+	select {
+	case r := <-recv:
+		if r.err != nil || string(r.payload) != string(Payload) {
+			t.Fatalf("Recv: have %q, %v", r.payload, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Concurrent Recv did not receive the packet")
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	c := initConn(t, 12348)
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(time.Second / 10))
+	_, _, err := c.Recv()
+
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Expected timeout error, have %v", err)
+	}
+
+	c.SetReadDeadline(time.Time{})
+	c.Send(&net.UDPAddr{Port: 12348}, Payload)
+
+	_, payload, err := c.Recv()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(payload) != string(Payload) {
+		t.Fatalf("Payload mismatch: Want %q, have %q", Payload, payload)
+	}
+}
+
+func TestRecvInto(t *testing.T) {
+	c := initConn(t, 12349)
+	defer c.Close()
+
+	addr := &net.UDPAddr{Port: 12349}
+	buf := make([]byte, len(Payload))
+
+	c.Send(addr, Payload)
+	_, n, err := c.RecvInto(buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf[:n]) != string(Payload) {
+		t.Fatalf("Payload mismatch: Want %q, have %q", Payload, buf[:n])
+	}
+
+	c.Send(addr, Payload)
+	_, n, err = c.RecvInto(buf[:4])
+
+	if err != io.ErrShortBuffer || n != 4 {
+		t.Fatalf("Expected short buffer: Have %d, %v", n, err)
+	}
+
+	c.Send(addr, Payload)
+	p, err := c.RecvPacket()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(p.Payload) != string(Payload) {
+		t.Fatalf("Payload mismatch: Want %q, have %q", Payload, p.Payload)
+	}
+
+	p.Release()
+}
+
+func TestBatch(t *testing.T) {
+	c := initConn(t, 12350)
+	defer c.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12350}
+	out := make([]Packet, 8)
+
+	for i := range out {
+		out[i].Addr = addr
+		out[i].Payload = []byte{byte(i)}
+	}
+
+	n, err := c.SendBatch(out)
+
+	if err != nil || n != len(out) {
+		t.Fatalf("SendBatch: Want %d, have %d, %v", len(out), n, err)
+	}
+
+	in := make([]Packet, len(out))
+	defer func() {
+		for i := range in {
+			in[i].Release()
+		}
+	}()
+
+	var count int
+	for count < len(out) {
+		n, err = c.RecvBatch(in)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < n; i++ {
+			if len(in[i].Payload) != 1 || in[i].Payload[0] != byte(count) {
+				t.Fatalf("Payload mismatch at %d: Have %v", count, in[i].Payload)
+			}
+
+			count++
+		}
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	c := New(1400)
+	c.Register(&failPlugin{fail: 3})
+
+	err := c.Open(12365)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12365}
+	out := make([]Packet, 8)
+
+	for i := range out {
+		out[i].Addr = addr
+		out[i].Payload = []byte{byte(i)}
+	}
+
+	if n, err := c.SendBatch(out); err != nil || n != len(out) {
+		t.Fatalf("SendBatch: Want %d, have %d, %v", len(out), n, err)
+	}
+
+	in := make([]Packet, len(out))
+	defer func() {
+		for i := range in {
+			in[i].Release()
+		}
+	}()
+
+	// The failing packet must not take the ones after it along.
+	var got []byte
+
+	for len(got) < len(out)-1 {
+		n, err := c.RecvBatch(in)
+
+		if err != nil && err != errFail {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < n; i++ {
+			got = append(got, in[i].Payload...)
+		}
+	}
+
+	if want := []byte{0, 1, 2, 4, 5, 6, 7}; string(got) != string(want) {
+		t.Fatalf("Want payloads %v, have %v", want, got)
+	}
+}
+
+// BenchmarkSendBatch sends batches of packets. This does not allocate.
+func BenchmarkSendBatch(b *testing.B) {
+	c, out, _ := initBatch(b, 12368)
+	defer c.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := c.SendBatch(out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRecvBatch receives batches of packets. Once the packets hold
+// their buffers, the only allocations are the source addresses of the
+// packets.
+func BenchmarkRecvBatch(b *testing.B) {
+	c, out, in := initBatch(b, 12369)
+	defer c.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+
+		if _, err := c.SendBatch(out); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StartTimer()
+
+		for count := 0; count < len(out); {
+			n, err := c.RecvBatch(in)
+
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			count += n
+		}
+	}
+}
+
+// initBatch opens a connection and creates a batch of packets addressed
+// to it, along with a batch to receive them in. The receiving packets
+// already hold their buffers.
+func initBatch(b *testing.B, port int) (*Connection, []Packet, []Packet) {
+	c := New(1400)
+	err := c.Open(port)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	out := make([]Packet, 8)
+	in := make([]Packet, len(out))
+
+	for i := range out {
+		out[i].Addr = addr
+		out[i].Payload = Payload
+		in[i].buf = c.buffers.Get().(*[]byte)
+	}
+
+	return c, out, in
+}
+
+func TestDial(t *testing.T) {
+	srv := initConn(t, 12351)
+	defer srv.Close()
+
+	c, err := Dial("udp", "127.0.0.1:12351", 1400)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	_, err = c.Write(Payload)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, payload, err := srv.Recv()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sameAddr(addr, c.LocalAddr()) {
+		t.Fatalf("Address mismatch: Want %v, have %v", c.LocalAddr(), addr)
+	}
+
+	srv.Send(addr, payload)
+
+	buf := make([]byte, len(Payload))
+	n, err := c.Read(buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf[:n]) != string(Payload) {
+		t.Fatalf("Payload mismatch: Want %q, have %q", Payload, buf[:n])
+	}
+
+	err = c.Send(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, Payload)
+
+	if err != ErrRemoteAddr {
+		t.Fatalf("Expected ErrRemoteAddr, have %v", err)
+	}
+}
+
+func TestOpenAddr(t *testing.T) {
+	var tp testPlugin
+
+	c := New(1400)
+	c.Register(&tp)
+
+	err := c.OpenAddr("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	addr := c.LocalAddr().(*net.UDPAddr)
+
+	if addr.Port == 0 || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("Unexpected local address %v", addr)
+	}
+
+	if tp.port != addr.Port {
+		t.Fatalf("Plugin port mismatch: Want %d, have %d", addr.Port, tp.port)
+	}
+
+	err = New(1400).OpenAddr("tcp", "127.0.0.1:0")
+
+	if err == nil {
+		t.Fatalf("Expected error for tcp network")
+	}
+}
+
+func TestNewFromPacketConn(t *testing.T) {
+	var tp testPlugin
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer pc.Close()
+
+	_, err = NewFromPacketConn(pc, 1400, &orderPlugin{stage: Stage(-1)})
+
+	if err != ErrStage {
+		t.Fatalf("Invalid stage was not rejected: %v", err)
+	}
+
+	c, err := NewFromPacketConn(pc, 1400, &tp)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tp.port != pc.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("Plugin port mismatch: Want %v, have %d", pc.LocalAddr(), tp.port)
+	}
+
+	c.Send(pc.LocalAddr(), Payload)
+	_, payload, err := c.Recv()
+
+	if err != nil || string(payload) != string(Payload) {
+		t.Fatalf("Recv: have %q, %v", payload, err)
+	}
+
+	c.SetKeepOpen(true)
+	c.Close()
+
+	// The socket must still be usable.
+	_, err = pc.WriteTo(Payload, pc.LocalAddr())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConcurrency exercises a connection from many goroutines at once.
+// Run with -race to detect unsynchronized access.
+func TestConcurrency(t *testing.T) {
+	var plugins [4]countPlugin
+	var wg sync.WaitGroup
+
+	c := initConn(t, 12352)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12352}
+	done := make(chan struct{})
+
+	for i := range plugins {
+		c.Register(&plugins[i])
+	}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				_, _, err := c.Recv()
+
+				if err != nil {
+					return
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if c.Send(addr, Payload) == ErrConnectionectionClosed {
+					return
+				}
+			}
+		}()
+	}
+
+	// Swap plugins while traffic is flowing.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			p := &plugins[i%len(plugins)]
+			c.Unregister(p)
+			c.Register(p)
+			c.SetPlugins(PluginList{&plugins[0], &plugins[1], &plugins[2], &plugins[3]})
+			c.SetReadDeadline(time.Time{})
+			c.PayloadSize()
+		}
+	}()
+
+	<-time.After(time.Second / 4)
+	close(done)
+
+	err := c.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Wait()
+
+	for i := range plugins {
+		if plugins[i].sent.Load() == 0 || plugins[i].recv.Load() == 0 {
+			t.Fatalf("Plugin %d was not used", i)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	const count = 200
+
+	c := initConn(t, 12357)
+	c.SetReaders(4)
+
+	var mu sync.Mutex
+	var errs []string
+	last := make(map[string]int)
+	busy := make(map[string]bool)
+	recv := make(chan struct{}, 2*count)
+
+	handler := func(addr net.Addr, payload []byte) {
+		key := addr.String()
+
+		mu.Lock()
+		if busy[key] {
+			errs = append(errs, "Concurrent handler calls for "+key)
+		}
+		busy[key] = true
+		mu.Unlock()
+
+		seq := int(binary.BigEndian.Uint32(payload))
+		runtime.Gosched()
+
+		mu.Lock()
+		if seq <= last[key] {
+			errs = append(errs, fmt.Sprintf("Out of order payload from %s: %d after %d", key, seq, last[key]))
+		}
+		last[key] = seq
+		busy[key] = false
+		mu.Unlock()
+
+		recv <- struct{}{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+
+	go func() { served <- c.Serve(ctx, handler) }()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12357}
+
+	for i := 0; i < 2; i++ {
+		uc, err := net.DialUDP("udp", nil, addr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer uc.Close()
+
+		go func() {
+			var b [4]byte
+
+			for seq := 1; seq <= count; seq++ {
+				binary.BigEndian.PutUint32(b[:], uint32(seq))
+				uc.Write(b[:])
+
+				if seq%20 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}()
+	}
+
+	// Loopback may drop packets under load. Ordering is what matters.
+	timeout := time.After(time.Second)
+
+wait:
+	for i := 0; i < 2*count; i++ {
+		select {
+		case <-recv:
+		case <-timeout:
+			break wait
+		}
+	}
+
+	cancel()
+
+	err := <-served
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, e := range errs {
+		t.Error(e)
+	}
+
+	if len(last) != 2 {
+		t.Fatalf("Expected payloads from 2 peers; have %d", len(last))
+	}
+
+	// Close ends Serve as well.
+	go func() { served <- c.Serve(context.Background(), handler) }()
+
+	time.Sleep(time.Millisecond * 10)
+	c.Close()
+
+	if err = <-served; err != ErrConnectionectionClosed {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestIncoming(t *testing.T) {
+	for i, test := range []struct {
+		policy  Policy
+		want    string
+		dropped int64
+	}{
+		{Block, "01234", 0},
+		{DropNewest, "01", 3},
+		{DropOldest, "34", 3},
+	} {
+		port := 12358 + i
+		c := initConn(t, port)
+		in := c.Incoming(2, test.policy)
+
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+
+		for _, b := range "01234" {
+			c.Send(addr, []byte{byte(b)})
+		}
+
+		// Give the receiving goroutine time to fill the buffer.
+		time.Sleep(time.Millisecond * 50)
+
+		var have []byte
+
+		for len(have) < len(test.want) {
+			select {
+			case p := <-in:
+				have = append(have, p.Payload...)
+				p.Release()
+			case <-time.After(time.Second):
+				t.Fatalf("Policy %d: Timed out after %q", test.policy, have)
+			}
+		}
+
+		if string(have) != test.want {
+			t.Fatalf("Policy %d: Want %q, have %q", test.policy, test.want, have)
+		}
+
+		if c.Dropped() != test.dropped {
+			t.Fatalf("Policy %d: Want %d dropped, have %d", test.policy, test.dropped, c.Dropped())
+		}
+
+		c.Close()
+
+		if _, ok := <-in; ok {
+			t.Fatalf("Policy %d: Channel was not closed", test.policy)
+		}
+	}
+}
+
+func TestIncomingDeadline(t *testing.T) {
+	c := initConn(t, 12367)
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(time.Millisecond * 20))
+	in := c.Incoming(1, Block)
+
+	// The deadline passes without closing the channel.
+	select {
+	case p, ok := <-in:
+		t.Fatalf("Unexpected packet: %q, %v", p.Payload, ok)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	c.SetReadDeadline(time.Time{})
+	c.Send(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12367}, Payload)
+
+	select {
+	case p, ok := <-in:
+		if !ok || string(p.Payload) != string(Payload) {
+			t.Fatalf("Incoming: have %q, %v", p.Payload, ok)
+		}
+
+		p.Release()
+	case <-time.After(time.Second):
+		t.Fatalf("Packet was not received after moving the deadline")
+	}
+}
+
+func TestListen(t *testing.T) {
+	l, err := Listen("udp4", "127.0.0.1:0", 1400)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	var clients [2]*Connection
+
+	for i := range clients {
+		clients[i], err = Dial("udp4", l.Addr().String(), 1400)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer clients[i].Close()
+
+		clients[i].Write([]byte{byte(i)})
+	}
+
+	buf := make([]byte, 16)
+
+	for range clients {
+		s, err := l.AcceptSession()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := s.Read(buf)
+
+		if err != nil || n != 1 {
+			t.Fatalf("Read failed: %d, %v", n, err)
+		}
+
+		client := clients[buf[0]]
+
+		if s.RemoteAddr().String() != client.LocalAddr().String() {
+			t.Fatalf("Address mismatch: Want %v, have %v", client.LocalAddr(), s.RemoteAddr())
+		}
+
+		s.Write(Payload)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err = client.Read(buf)
+
+		if err != nil || string(buf[:n]) != string(Payload) {
+			t.Fatalf("Echo failed: %q, %v", buf[:n], err)
+		}
+
+		s.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+		_, err = s.Read(buf)
+
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("Expected timeout; have %v", err)
+		}
+
+		s.Close()
+
+		if _, err = s.Read(buf); err != ErrConnectionectionClosed {
+			t.Fatalf("Read on closed session: %v", err)
+		}
+	}
+
+	// A closed session's peer starts a new one.
+	clients[0].Write([]byte{0})
+	s, err := l.AcceptSession()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Close()
+
+	if _, err = l.Accept(); err != ErrConnectionectionClosed {
+		t.Fatalf("Accept on closed listener: %v", err)
+	}
+
+	if _, err = s.Write(Payload); err != ErrConnectionectionClosed {
+		t.Fatalf("Write on closed listener: %v", err)
+	}
+}
+
+func TestListenKeyer(t *testing.T) {
+	l, err := Listen("udp4", "127.0.0.1:0", 1400, new(keyPlugin))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	// Two sockets with the same key belong to the same peer.
+	for i := 0; i < 2; i++ {
+		c, err := Dial("udp4", l.Addr().String(), 1400, new(keyPlugin))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer c.Close()
+
+		c.Write([]byte{byte(i)})
+	}
+
+	s, err := l.AcceptSession()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+
+	for i := 0; i < 2; i++ {
+		s.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := s.Read(buf)
+
+		if err != nil || n != 1 || buf[0] != byte(i) {
+			t.Fatalf("Read %d failed: %v, %v", i, buf[:n], err)
+		}
+	}
+
+	select {
+	case s := <-l.accept:
+		t.Fatalf("Unexpected session for %v", s.RemoteAddr())
+	default:
+	}
+}
+
+// keyPlugin identifies all peers by the same key.
+type keyPlugin struct{}
+
+func (p *keyPlugin) PayloadSize() int                       { return 1 }
+func (p *keyPlugin) Open(port int) error                    { return nil }
+func (p *keyPlugin) Close() error                           { return nil }
+func (p *keyPlugin) Send(a net.Addr, b []byte, i int) error { b[0] = 'k'; return nil }
+func (p *keyPlugin) Recv(net.Addr, []byte, int) error       { return nil }
+func (p *keyPlugin) PeerKey(a net.Addr, b []byte) string    { return string(b[:1]) }
+
+func TestPeerPlugin(t *testing.T) {
+	pp := &peerPlugin{closed: make(map[string]int)}
+
+	c := initConn(t, 12361)
+	c.Register(pp)
+	c.SetPeerTimeout(time.Millisecond * 50)
+
+	other := initConn(t, 12362)
+	defer other.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12361}
+
+	for i := 0; i < 3; i++ {
+		other.Send(addr, Payload)
+		c.Recv()
+	}
+
+	c.Send(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12362}, Payload)
+	other.Recv()
+
+	pp.mu.Lock()
+	if len(pp.peers) != 1 || *pp.peers["127.0.0.1:12362"] != 4 {
+		t.Fatalf("Unexpected peer state: %v", pp.peers)
+	}
+	pp.mu.Unlock()
+
+	// The peer is evicted once it is idle. Talking to ourselves
+	// creates a new peer.
+	time.Sleep(time.Millisecond * 100)
+	c.Send(addr, Payload)
+	c.Recv()
+
+	pp.mu.Lock()
+	if pp.closed["127.0.0.1:12362"] != 1 || *pp.peers["127.0.0.1:12361"] != 2 {
+		t.Fatalf("Peer was not evicted: %v, %v", pp.closed, pp.peers)
+	}
+	pp.mu.Unlock()
+
+	c.Close()
+
+	if pp.closed["127.0.0.1:12361"] != 1 {
+		t.Fatalf("Peer was not released on Close: %v", pp.closed)
+	}
+}
+
+// peerPlugin counts the packets exchanged with each peer.
+type peerPlugin struct {
+	mu     sync.Mutex
+	peers  map[string]*int
+	closed map[string]int
+}
+
+func (p *peerPlugin) PayloadSize() int                 { return 0 }
+func (p *peerPlugin) Open(port int) error              { return nil }
+func (p *peerPlugin) Close() error                     { return nil }
+func (p *peerPlugin) Send(net.Addr, []byte, int) error { panic("Send called") }
+func (p *peerPlugin) Recv(net.Addr, []byte, int) error { panic("Recv called") }
+
+func (p *peerPlugin) NewPeer(addr net.Addr) interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peers == nil {
+		p.peers = make(map[string]*int)
+	}
+
+	n := new(int)
+	p.peers[addr.String()] = n
+	return n
+}
+
+func (p *peerPlugin) ClosePeer(addr net.Addr, state interface{}) {
+	p.mu.Lock()
+	p.closed[addr.String()]++
+	p.mu.Unlock()
+}
+
+func (p *peerPlugin) SendPeer(state interface{}, addr net.Addr, b []byte, index int) (int, error) {
+	p.mu.Lock()
+	*state.(*int)++
+	p.mu.Unlock()
+	return 0, nil
+}
+
+func (p *peerPlugin) RecvPeer(state interface{}, addr net.Addr, b []byte, index int) error {
+	p.mu.Lock()
+	*state.(*int)++
+	p.mu.Unlock()
+	return nil
+}
+
+func TestController(t *testing.T) {
+	var cp controlPlugin
+	var fp fixedPlugin
+
+	c := initConn(t, 12363)
+	c.Register(&fp)
+	c.Register(&cp)
+
+	if cp.inj == nil {
+		t.Fatalf("Injector was not set")
+	}
+
+	if c.PayloadSize() != 1400-UDPHeaderSize-4-1 {
+		t.Fatalf("Unexpected payload size %d", c.PayloadSize())
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12363}
+
+	err := cp.inj.Inject(addr, []byte("ping"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, payload, err := c.Recv()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payload != nil || !cp.control || string(cp.payload) != "ping" {
+		t.Fatalf("Control packet mismatch: %q, %v, %q", payload, cp.control, cp.payload)
+	}
+
+	c.Send(addr, Payload)
+	_, payload, err = c.Recv()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(payload) != string(Payload) || cp.control {
+		t.Fatalf("Payload mismatch: Want %q, have %q", Payload, payload)
+	}
+
+	inj := cp.inj
+	c.Close()
+
+	if cp.inj != nil {
+		t.Fatalf("Injector was not unset")
+	}
+
+	if inj.Inject(addr, nil) != ErrConnectionectionClosed {
+		t.Fatalf("Inject succeeded on a closed connection")
+	}
+}
+
+// controlPlugin records whether it received a control packet.
+type controlPlugin struct {
+	inj     Injector
+	control bool
+	payload []byte
+}
+
+func (p *controlPlugin) PayloadSize() int                 { return 0 }
+func (p *controlPlugin) Open(port int) error              { return nil }
+func (p *controlPlugin) Close() error                     { return nil }
+func (p *controlPlugin) Send(net.Addr, []byte, int) error { return nil }
+func (p *controlPlugin) SetInjector(inj Injector)         { p.inj = inj }
+
+func (p *controlPlugin) Recv(addr net.Addr, b []byte, index int) error {
+	p.control = IsControl(b, index)
+	p.payload = append(p.payload[:0], b[index:]...)
+	return nil
+}
+
+func TestControlReader(t *testing.T) {
+	var fp fixedPlugin
+
+	c := New(1400)
+	c.Register(&fp)
+	c.Register(&readerPlugin{reads: false})
+
+	if c.PayloadSize() != 1400-UDPHeaderSize-4 {
+		t.Fatalf("Unexpected payload size %d", c.PayloadSize())
+	}
+
+	c.Register(&readerPlugin{reads: true})
+
+	if c.PayloadSize() != 1400-UDPHeaderSize-4-1 {
+		t.Fatalf("Flag byte was not reserved: payload size %d", c.PayloadSize())
+	}
+}
+
+// readerPlugin asks for the control flag, if reads is set.
+type readerPlugin struct {
+	reads bool
+}
+
+func (p *readerPlugin) PayloadSize() int                 { return 0 }
+func (p *readerPlugin) Open(port int) error              { return nil }
+func (p *readerPlugin) Close() error                     { return nil }
+func (p *readerPlugin) Send(net.Addr, []byte, int) error { return nil }
+func (p *readerPlugin) Recv(net.Addr, []byte, int) error { return nil }
+func (p *readerPlugin) ReadsControl() bool               { return p.reads }
+
+func TestTicker(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	tp := &tickPlugin{interval: time.Millisecond * 10}
+	pp := &peerPlugin{closed: make(map[string]int)}
+
+	c := New(1400)
+	c.SetClock(clock)
+	c.SetPeerTimeout(time.Second)
+	c.Register(tp)
+	c.Register(pp)
+
+	err := c.Open(12364)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	start := clock.Now()
+	clock.Advance(time.Millisecond * 25)
+
+	want := []time.Time{
+		start.Add(time.Millisecond * 10),
+		start.Add(time.Millisecond * 20),
+	}
+
+	if fmt.Sprint(tp.ticks) != fmt.Sprint(want) {
+		t.Fatalf("Tick mismatch:\nWant %v\nHave %v", want, tp.ticks)
+	}
+
+	// Peers are evicted on a tick, once they have been idle long enough.
+	c.Send(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12364}, Payload)
+	c.Recv()
+
+	clock.Advance(time.Second)
+
+	if len(pp.closed) != 0 {
+		t.Fatalf("Peer was evicted too early: %v", pp.closed)
+	}
+
+	clock.Advance(time.Second)
+
+	if pp.closed["127.0.0.1:12364"] != 1 {
+		t.Fatalf("Peer was not evicted: %v", pp.closed)
+	}
+
+	// Unregistered tickers are no longer ticked.
+	c.Unregister(tp)
+	n := len(tp.ticks)
+	clock.Advance(time.Second)
+
+	if len(tp.ticks) != n {
+		t.Fatalf("Unregistered plugin was ticked")
+	}
+}
+
+// tickPlugin records the times at which it was ticked.
+type tickPlugin struct {
+	interval time.Duration
+	ticks    []time.Time
+}
+
+func (p *tickPlugin) PayloadSize() int                 { return 0 }
+func (p *tickPlugin) Open(port int) error              { return nil }
+func (p *tickPlugin) Close() error                     { return nil }
+func (p *tickPlugin) Send(net.Addr, []byte, int) error { return nil }
+func (p *tickPlugin) Recv(net.Addr, []byte, int) error { return nil }
+func (p *tickPlugin) TickInterval() time.Duration      { return p.interval }
+func (p *tickPlugin) Tick(now time.Time)               { p.ticks = append(p.ticks, now) }
+
+// fakeClock only moves forward when told to. Timers run on the goroutine
+// which calls Advance.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	f     func()
+	done  bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward, running all timers which expire
+// along the way.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+
+	for {
+		var next *fakeTimer
+
+		for _, t := range c.timers {
+			if !t.done && !t.at.After(end) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		next.done = true
+
+		if next.at.After(c.now) {
+			c.now = next.at
+		}
+
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+
+	c.now = end
+	c.mu.Unlock()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	stopped := !t.done
+	t.done = true
+	return stopped
+}
+
+func TestVarPlugin(t *testing.T) {
+	var vp varPlugin
+	var fp fixedPlugin
+
+	c := New(1400)
+	c.Register(&vp)
+	c.Register(&fp)
+
+	err := c.Open(12353)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if c.PayloadSize() != 1400-UDPHeaderSize-binary.MaxVarintLen64-4 {
+		t.Fatalf("Unexpected payload size %d", c.PayloadSize())
+	}
+
+	addr := &net.UDPAddr{Port: 12353}
+
+	for _, seq := range []uint64{1, 300, 1 << 40} {
+		vp.seq = seq
+		c.Send(addr, Payload)
+
+		_, payload, err := c.Recv()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if vp.recv != seq {
+			t.Fatalf("Sequence mismatch: Want %d, have %d", seq, vp.recv)
+		}
+
+		if string(fp.payload) != string(Payload) {
+			t.Fatalf("Plugin payload mismatch: Want %q, have %q", Payload, fp.payload)
+		}
+
+		if string(payload) != string(Payload) {
+			t.Fatalf("Payload mismatch: Want %q, have %q", Payload, payload)
+		}
+	}
+}
+
+func TestTrailerPlugin(t *testing.T) {
+	var fp fixedPlugin
+
+	c := New(1400)
+	c.Register(&crcPlugin{})
+	c.Register(&fp)
+
+	err := c.Open(12354)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if c.PayloadSize() != 1400-UDPHeaderSize-4-4 {
+		t.Fatalf("Unexpected payload size %d", c.PayloadSize())
+	}
+
+	addr := &net.UDPAddr{Port: 12354}
+	c.Send(addr, Payload)
+
+	_, payload, err := c.Recv()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(fp.payload) != string(Payload) {
+		t.Fatalf("Plugin payload mismatch: Want %q, have %q", Payload, fp.payload)
+	}
+
+	if string(payload) != string(Payload) {
+		t.Fatalf("Payload mismatch: Want %q, have %q", Payload, payload)
+	}
+
+	// A corrupted packet must be discarded.
+	uc, err := net.DialUDP("udp", nil, addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer uc.Close()
+
+	uc.Write(append([]byte("xudp"), "Hello, world\x00\x00\x00\x00"...))
+
+	_, payload, err = c.Recv()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payload != nil {
+		t.Fatalf("Corrupt packet was not discarded: %q", payload)
+	}
+}
+
+func TestTransformer(t *testing.T) {
+	var fp fixedPlugin
+
+	// The padding is applied first, so the other plugins see its result.
+	c := New(1400)
+	c.Register(&fp)
+	c.Register(&crcPlugin{})
+	c.Register(&padPlugin{})
+
+	err := c.Open(12355)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	if c.PayloadSize() != 1400-UDPHeaderSize-4-4-16 {
+		t.Fatalf("Unexpected payload size %d", c.PayloadSize())
+	}
+
+	addr := &net.UDPAddr{Port: 12355}
+	big := make([]byte, c.PayloadSize())
+
+	for _, want := range [][]byte{Payload, big} {
+		err = c.Send(addr, want)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, payload, err := c.Recv()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(fp.payload)%16 != 0 {
+			t.Fatalf("Plugin did not see the padded payload: %d bytes", len(fp.payload))
+		}
+
+		if string(payload) != string(want) {
+			t.Fatalf("Payload mismatch: Want %q, have %q", want, payload)
+		}
+	}
+
+	if c.Send(addr, append(big, 0)) != ErrPacketSize {
+		t.Fatalf("Oversized payload was not rejected")
+	}
+}
+
+func TestStage(t *testing.T) {
+	var calls []string
+
+	filter := &orderPlugin{name: "filter", stage: StageFilter, calls: &calls}
+	security := &orderPlugin{name: "security", stage: StageSecurity, calls: &calls}
+	transport1 := &orderPlugin{name: "transport1", stage: StageTransport, calls: &calls}
+	transport2 := &orderPlugin{name: "transport2", stage: StageTransport, calls: &calls}
+	delivery := &orderPlugin{name: "delivery", stage: StageDelivery, calls: &calls}
+
+	c := New(1400)
+	c.Register(delivery)
+	c.Register(transport1)
+	c.Register(security)
+	c.Register(transport2)
+	c.Register(filter)
+
+	want := PluginList{filter, security, transport1, transport2, delivery}
+	have := c.Plugins()
+
+	for i := range want {
+		if have[i] != want[i] {
+			t.Fatalf("Plugin order mismatch at %d: Want %v, have %v", i, want[i], have[i])
+		}
+	}
+
+	if c.Register(&orderPlugin{stage: Stage(-1)}) != ErrStage {
+		t.Fatalf("Invalid stage was not rejected")
+	}
+
+	if c.SetPlugins(PluginList{filter, &orderPlugin{stage: 42}}) != ErrStage {
+		t.Fatalf("Invalid stage was not rejected")
+	}
+
+	err := c.Open(12356)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	c.Send(&net.UDPAddr{Port: 12356}, Payload)
+
+	_, payload, err := c.Recv()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(payload) != string(Payload) {
+		t.Fatalf("Payload mismatch: Want %q, have %q", Payload, payload)
+	}
+
+	expect := []string{
+		"send delivery", "send transport2", "send transport1", "send security", "send filter",
+		"recv filter", "recv security", "recv transport1", "recv transport2", "recv delivery",
+	}
+
+	if fmt.Sprint(calls) != fmt.Sprint(expect) {
+		t.Fatalf("Call order mismatch:\nWant %v\nHave %v", expect, calls)
+	}
+}
+
+// orderPlugin records the order in which plugins are called. Its header
+// holds its name, which it verifies on receipt.
+type orderPlugin struct {
+	name  string
+	stage Stage
+	calls *[]string
+}
+
+func (p *orderPlugin) PayloadSize() int    { return len(p.name) }
+func (p *orderPlugin) Stage() Stage        { return p.stage }
+func (p *orderPlugin) Open(port int) error { return nil }
+func (p *orderPlugin) Close() error        { return nil }
+func (p *orderPlugin) String() string      { return p.name }
+
+func (p *orderPlugin) Send(addr net.Addr, b []byte, index int) error {
+	*p.calls = append(*p.calls, "send "+p.name)
+	copy(b, p.name)
+	return nil
+}
+
+func (p *orderPlugin) Recv(addr net.Addr, b []byte, index int) error {
+	*p.calls = append(*p.calls, "recv "+p.name)
+
+	if string(b[:len(p.name)]) != p.name {
+		return ErrDiscard
+	}
+
+	return nil
+}
+
+// padPlugin pads the payload to a multiple of 16 bytes. The first
+// byte holds the number of padding bytes.
+type padPlugin struct{}
+
+func (p *padPlugin) PayloadSize() int                 { return 0 }
+func (p *padPlugin) Open(port int) error              { return nil }
+func (p *padPlugin) Close() error                     { return nil }
+func (p *padPlugin) Send(net.Addr, []byte, int) error { return nil }
+func (p *padPlugin) Recv(net.Addr, []byte, int) error { return nil }
+func (p *padPlugin) Overhead() int                    { return 16 }
+
+func (p *padPlugin) Encode(addr net.Addr, dst, src []byte) (int, error) {
+	pad := 16 - (len(src)+1)%16
+
+	if pad == 16 {
+		pad = 0
+	}
+
+	dst[0] = byte(pad)
+	n := 1 + copy(dst[1:], src)
+	clear(dst[n : n+pad])
+	return n + pad, nil
+}
+
+func (p *padPlugin) Decode(addr net.Addr, dst, src []byte) (int, error) {
+	if len(src) == 0 || int(src[0]) >= len(src) {
+		return 0, ErrDiscard
+	}
+
+	return copy(dst, src[1:len(src)-int(src[0])]), nil
+}
+
+// crcPlugin appends a CRC32 checksum of the packet.
+type crcPlugin struct{}
+
+func (p *crcPlugin) PayloadSize() int                 { return 0 }
+func (p *crcPlugin) Open(port int) error              { return nil }
+func (p *crcPlugin) Close() error                     { return nil }
+func (p *crcPlugin) Send(net.Addr, []byte, int) error { return nil }
+func (p *crcPlugin) Recv(net.Addr, []byte, int) error { return nil }
+func (p *crcPlugin) TrailerSize() int                 { return 4 }
+
+func (p *crcPlugin) SendTrailer(addr net.Addr, packet, trailer []byte) error {
+	binary.BigEndian.PutUint32(trailer, crc32.ChecksumIEEE(packet))
+	return nil
+}
+
+func (p *crcPlugin) RecvTrailer(addr net.Addr, packet, trailer []byte) error {
+	if binary.BigEndian.Uint32(trailer) != crc32.ChecksumIEEE(packet) {
+		return ErrDiscard
+	}
+
+	return nil
+}
+
+// varPlugin writes a variable length sequence number.
+type varPlugin struct {
+	seq, recv uint64
+}
+
+func (p *varPlugin) PayloadSize() int                 { return binary.MaxVarintLen64 }
+func (p *varPlugin) Open(port int) error              { return nil }
+func (p *varPlugin) Close() error                     { return nil }
+func (p *varPlugin) Send(net.Addr, []byte, int) error { return nil }
+
+func (p *varPlugin) SendVar(addr net.Addr, b []byte, index int) (int, error) {
+	return binary.PutUvarint(b, p.seq), nil
+}
+
+func (p *varPlugin) HeaderSize(b []byte) (int, error) {
+	_, n := binary.Uvarint(b)
+
+	if n <= 0 {
+		return 0, ErrDiscard
+	}
+
+	return n, nil
+}
+
+func (p *varPlugin) Recv(addr net.Addr, b []byte, index int) error {
+	p.recv, _ = binary.Uvarint(b)
+	return nil
+}
+
+// fixedPlugin writes a fixed size header and records the payload it sees.
+type fixedPlugin struct {
+	payload []byte
+}
+
+func (p *fixedPlugin) PayloadSize() int    { return 4 }
+func (p *fixedPlugin) Open(port int) error { return nil }
+func (p *fixedPlugin) Close() error        { return nil }
+
+func (p *fixedPlugin) Send(addr net.Addr, b []byte, index int) error {
+	copy(b, "xudp")
+	return nil
+}
+
+func (p *fixedPlugin) Recv(addr net.Addr, b []byte, index int) error {
+	if string(b[:4]) != "xudp" {
+		return ErrDiscard
+	}
+
+	p.payload = append(p.payload[:0], b[index:]...)
+	return nil
+}
+
+var errFail = errors.New("Packet failed.")
+
+// failPlugin fails to receive packets whose payload is the given byte.
+type failPlugin struct {
+	fail byte
+}
+
+func (p *failPlugin) PayloadSize() int                 { return 0 }
+func (p *failPlugin) Open(port int) error              { return nil }
+func (p *failPlugin) Close() error                     { return nil }
+func (p *failPlugin) Send(net.Addr, []byte, int) error { return nil }
+
+func (p *failPlugin) Recv(addr net.Addr, b []byte, index int) error {
+	if len(b) > index && b[index] == p.fail {
+		return errFail
+	}
+
+	return nil
+}
+
+// countPlugin counts the packets it sees.
+type countPlugin struct {
+	sent, recv atomic.Int64
+}
+
+func (p *countPlugin) PayloadSize() int                 { return 0 }
+func (p *countPlugin) Open(port int) error              { return nil }
+func (p *countPlugin) Close() error                     { return nil }
+func (p *countPlugin) Send(net.Addr, []byte, int) error { p.sent.Add(1); return nil }
+func (p *countPlugin) Recv(net.Addr, []byte, int) error { p.recv.Add(1); return nil }
+
+// testPlugin records the port it was opened with.
+type testPlugin struct {
+	port int
+}
+
+func (p *testPlugin) PayloadSize() int                 { return 0 }
+func (p *testPlugin) Open(port int) error              { p.port = port; return nil }
+func (p *testPlugin) Close() error                     { return nil }
+func (p *testPlugin) Send(net.Addr, []byte, int) error { return nil }
+func (p *testPlugin) Recv(net.Addr, []byte, int) error { return nil }
+
 func loop(t *testing.T, c *Connection) {
 	for {
 		addr, payload, err := c.Recv()
@@ -0,0 +1,231 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// A deadline far enough in the past to make any pending I/O fail immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// RecvContext receives a new payload, like Recv. It returns early when
+// the given context is cancelled or its deadline expires.
+//
+// If the context ends before a packet arrives, the returned error is a
+// net.Error. Its Timeout() method reports true if the context deadline
+// was exceeded. Other calls which receive from the connection at the
+// same time, are not affected.
+func (c *Connection) RecvContext(ctx context.Context) (addr net.Addr, payload []byte, err error) {
+	s := c.socket()
+
+	if s == nil {
+		return nil, nil, ErrConnectionectionClosed
+	}
+
+	stop, err := s.rd.watch(ctx)
+
+	if err != nil {
+		return
+	}
+
+	addr, payload, err = c.recvCopy(s, ctx.Done())
+	stop()
+
+	return addr, payload, contextError(ctx, err)
+}
+
+// SendContext sends the given payload to the specified destination, like
+// Send. It returns early when the given context is cancelled or its
+// deadline expires.
+func (c *Connection) SendContext(ctx context.Context, addr net.Addr, payload []byte) (err error) {
+	s := c.socket()
+
+	if s == nil {
+		return ErrConnectionectionClosed
+	}
+
+	stop, err := s.wd.watch(ctx)
+
+	if err != nil {
+		return
+	}
+
+	err = c.send(s, addr, payload, ctx.Done())
+	stop()
+
+	return contextError(ctx, err)
+}
+
+// interrupter interrupts blocking I/O on a socket on behalf of a single
+// caller. Socket deadlines apply to all pending calls at once. So the
+// deadline is moved into the past, and the calls which were not meant to
+// be interrupted, wait for the interruption to end and then try again.
+type interrupter struct {
+	set   func(time.Time) error // Sets the socket deadline.
+	mu    sync.Mutex            // Guards the fields below.
+	host  time.Time             // Deadline set by the host.
+	count int                   // Number of pending interruptions.
+	over  chan struct{}         // Closed when the interruptions are over.
+	moved chan struct{}         // Closed when the host deadline changes.
+}
+
+// setHost sets the deadline of the host. It is applied to the socket
+// once any pending interruptions are over.
+func (i *interrupter) setHost(t time.Time) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.host = t
+
+	if i.moved != nil {
+		close(i.moved)
+		i.moved = nil
+	}
+
+	if i.count > 0 {
+		return nil
+	}
+
+	return i.set(t)
+}
+
+// expired returns a channel which is closed once the host deadline is
+// moved. If it has not passed, the channel is closed already.
+func (i *interrupter) expired() <-chan struct{} {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.host.IsZero() || time.Now().Before(i.host) {
+		c := make(chan struct{})
+		close(c)
+		return c
+	}
+
+	if i.moved == nil {
+		i.moved = make(chan struct{})
+	}
+
+	return i.moved
+}
+
+// start interrupts all pending I/O. It must be followed by a call to end.
+func (i *interrupter) start() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.count == 0 {
+		i.over = make(chan struct{})
+	}
+
+	i.count++
+	i.set(aLongTimeAgo)
+}
+
+// end ends an interruption. The host deadline is restored once all
+// interruptions are over.
+func (i *interrupter) end() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.count--
+
+	if i.count > 0 {
+		return
+	}
+
+	i.set(i.host)
+	close(i.over)
+	i.over = nil
+}
+
+// retry returns true if an I/O call which failed with err, should be
+// tried again. This is the case for timeouts which were caused by an
+// interruption on behalf of another caller. It waits for the interruption
+// to end. The given channel is closed if the caller itself was interrupted.
+func (i *interrupter) retry(err error, cancel <-chan struct{}) bool {
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		return false
+	}
+
+	select {
+	case <-cancel:
+		return false
+	default:
+	}
+
+	i.mu.Lock()
+	host, over := i.host, i.over
+	i.mu.Unlock()
+
+	if !host.IsZero() && !time.Now().Before(host) {
+		return false // The host deadline has passed.
+	}
+
+	if over != nil {
+		select {
+		case <-over:
+		case <-cancel:
+			return false
+		}
+	}
+
+	return true
+}
+
+// watch arranges for pending I/O to be interrupted when the given context
+// ends. The I/O calls of the caller must pass ctx.Done() to retry.
+//
+// The returned function must be called once the caller's I/O has
+// completed. It ends the interruption, if there was one.
+func (i *interrupter) watch(ctx context.Context) (func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &ctxError{err}
+	}
+
+	if ctx.Done() == nil {
+		return func() {}, nil
+	}
+
+	done := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		i.start()
+		close(done)
+	})
+
+	return func() {
+		if !stop() {
+			<-done
+			i.end()
+		}
+	}, nil
+}
+
+// contextError replaces err with the context's error if the context
+// ended while the operation was pending.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if cerr := ctx.Err(); cerr != nil {
+		return &ctxError{cerr}
+	}
+
+	return err
+}
+
+// ctxError is returned when an operation is interrupted by its context.
+// It implements net.Error.
+type ctxError struct {
+	err error
+}
+
+func (e *ctxError) Error() string   { return e.err.Error() }
+func (e *ctxError) Unwrap() error   { return e.err }
+func (e *ctxError) Timeout() bool   { return e.err == context.DeadlineExceeded }
+func (e *ctxError) Temporary() bool { return e.Timeout() }
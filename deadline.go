@@ -0,0 +1,73 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline signals when a point in time has passed. It lets operations
+// which block on channels, rather than on a socket, honour deadlines.
+// The deadline may be changed while operations are waiting on it.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // Closed when the deadline has passed.
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline. A zero value means there is none.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer to close the channel.
+	}
+
+	d.timer = nil
+	expired := isClosed(d.cancel)
+
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel which is closed when the deadline has passed.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+// isClosed returns true if the given channel has been closed.
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,103 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import "net"
+
+// A dialed connection can be used wherever a net.Conn is expected.
+var _ net.Conn = (*Connection)(nil)
+
+// Dial opens a connection to the given remote address.
+//
+// The network must be "udp", "udp4" or "udp6". The given plugins are
+// registered and opened along with the connection.
+//
+// The connection uses a connected UDP socket. The operating system
+// drops any packets which do not come from the remote address, and
+// reports ICMP errors, such as an unreachable port, as errors from
+// subsequent Send and Recv calls.
+//
+// A dialed connection offers Read and Write methods, which do not need
+// an address. Together with its deadline methods, this lets it satisfy
+// the net.Conn interface.
+func Dial(network, raddr string, mtu uint32, plugins ...Plugin) (*Connection, error) {
+	addr, err := net.ResolveUDPAddr(network, raddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	uc, err := net.DialUDP(network, nil, addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := New(mtu)
+
+	for _, plg := range plugins {
+		err = c.Register(plg)
+
+		if err != nil {
+			uc.Close()
+			return nil, err
+		}
+	}
+
+	err = c.open(uc, uc.RemoteAddr())
+
+	if err != nil {
+		uc.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// RemoteAddr returns the remote network address of a dialed connection.
+// Returns nil for any other connection.
+func (c *Connection) RemoteAddr() net.Addr {
+	s := c.socket()
+
+	if s == nil {
+		return nil
+	}
+
+	return s.raddr
+}
+
+// Read receives the payload of the next packet from the remote end point
+// into b. Packets without payload data are skipped.
+//
+// This is only supported by dialed connections.
+func (c *Connection) Read(b []byte) (int, error) {
+	if s := c.socket(); s != nil && s.raddr == nil {
+		return 0, ErrNotConnected
+	}
+
+	for {
+		_, n, err := c.RecvInto(b)
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Write sends b as a single packet to the remote end point.
+//
+// This is only supported by dialed connections.
+func (c *Connection) Write(b []byte) (int, error) {
+	if s := c.socket(); s != nil && s.raddr == nil {
+		return 0, ErrNotConnected
+	}
+
+	err := c.Send(nil, b)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
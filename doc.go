@@ -25,12 +25,66 @@ During `Send` or `Recv` calls, each plugin is passed the sender/receiver's
 address and the packet payload, starting at the byte offset for that specific
 plugin. It can then access the first byte of data simply at `payload[0]`.
 
+Plugins whose header size differs from one packet to the next, implement
+the `xudp.VarPlugin` interface. Their `PayloadSize` reports the largest
+header they can write. When sending, they report how many bytes they
+actually wrote. When receiving, they report how many bytes their header
+takes up, before any plugin processes the packet.
+
+Plugins are layered like an onion. Each plugin belongs to a stage:
+`xudp.StageFilter`, `xudp.StageSecurity`, `xudp.StageTransport`, which
+is the default, or `xudp.StageDelivery`. Plugins declare their stage by
+implementing the `xudp.Stager` interface. The connection orders plugins
+by stage and then by order of registration. Received packets are processed from the
+outermost layer inwards, so cheap filters run first and decryption runs
+before the transport plugins see anything. Packets being sent are
+processed in the reverse order. Each plugin wraps the packet built by
+the plugins inside of it.
+
+Plugins which append data after the payload, such as checksums, implement
+the `xudp.TrailerPlugin` interface. A trailer covers the plugin's own
+header and everything inside it. Received packets have their trailers
+verified and stripped, before the plugins process their headers.
+
+Plugins which replace the packet contents with data of a different size,
+such as compression or encryption, implement the `xudp.Transformer`
+interface. They encode everything inside their own layer into a buffer
+provided by the connection. Incoming data is decoded once the plugin
+has processed its header. The maximum payload size accounts for the
+`Overhead` each transformer may add.
+
 While some plugins can be re-used by multiple connections, it is not
 recommended to do so. Some plugins retain internal state on a per-connection
 basis. Re-using the same instance in other connections will mess up the
 internals. It is therefore advised to give each connection their own,
 new instance of a given plugin.
 
+Plugins which keep state for each peer, such as sequence numbers,
+implement the `xudp.PeerPlugin` interface. The connection stores this
+state separately for each peer and hands it to the plugin with every
+packet. The state for a peer is released once it has been idle for
+a while. See `Connection.SetPeerTimeout`.
+
+Plugins which need to send packets of their own, such as acknowledgements
+or keepalives, implement the `xudp.Controller` interface. They are handed
+an `xudp.Injector`, which queues control packets to a peer. Control
+packets pass through all plugins, but never surface as application data.
+Plugins can tell them apart with `xudp.IsControl`. Plugins which only
+need to recognize control packets implement `xudp.ControlReader` instead.
+
+Plugins which need to do work at regular intervals, such as expiring
+timeouts, implement the `xudp.Ticker` interface. A connection ticks all
+of them from a single scheduler while it is open, so plugins need no
+goroutines of their own. The scheduler follows the connection's
+`xudp.Clock`, which tests can replace through `Connection.SetClock` to
+control the passing of time.
+
+A connection is safe for concurrent use. Send and Recv can be called
+from different goroutines, and plugins can be registered or replaced
+while packets are flowing. Plugins are called from whichever goroutine
+sends or receives a packet, so they must be safe for concurrent use
+as well.
+
 Individual plugins may expose additional fields and methods, useful for
 the host. These can be accessed by assrting the `xudp.Plugin` type to its
 concrete implementation type. Refer to each plugin's documentation for
@@ -42,12 +96,44 @@ Example for setup and use of a connection:
 	conn.Register(protocol.New(...))
 	...
 
+Clients which only talk to a single server can dial it instead. A
+dialed connection implements net.Conn:
+
+	conn, err := xudp.Dial("udp", "example.com:30000", MTU, protocol.New(ProtocolId))
+	...
+	n, err := conn.Write(payload)
+	n, err = conn.Read(buf)
+
+Servers can listen for peers instead. Each peer gets its own session,
+which implements net.Conn. Peers are told apart by their address, or by
+their peer hash when the ident plugin is registered:
+
+	l, err := xudp.Listen("udp", ":30000", MTU, protocol.New(ProtocolId))
+	...
+	session, err := l.Accept()
+	...
+	n, err := session.Read(buf)
+
 Open the connection for incoming data:
 
 	err := conn.Open(port)
 	...
 	defer conn.Close()
 
+Or bind to a specific address and address family. A zero port picks
+any available port:
+
+	err := conn.OpenAddr("udp4", "192.168.1.10:0")
+	...
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+Existing sockets, such as those passed on through systemd socket
+activation, can be wrapped as well:
+
+	pcs, err := xudp.ListenFDs()
+	...
+	conn, err := xudp.NewFromPacketConn(pcs[0], MTU, protocol.New(ProtocolId))
+
 Sending & receiving data:
 
 	for {
@@ -55,5 +141,45 @@ Sending & receiving data:
 		...
 		err := conn.Send(addr, payload)
 	}
+
+Recv blocks until a packet arrives. Use deadlines or a context to
+bound the wait. Timeouts are reported as a net.Error:
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	addr, payload, err := conn.RecvContext(ctx)
+
+Recv returns a newly allocated payload. Busy servers can avoid this by
+receiving into their own buffer, or by borrowing one of the connection's
+internal buffers:
+
+	addr, n, err := conn.RecvInto(buf)
+	...
+
+	packet, err := conn.RecvPacket()
+	...
+	packet.Release()
+
+RecvBatch and SendBatch move several packets per call. On Linux, each
+call maps onto a single recvmmsg(2) or sendmmsg(2) system call.
+
+Serve runs the receive loop for you. It calls a handler for every
+payload, using several goroutines at once. Payloads from the same peer
+are handled one at a time, in the order in which they arrived:
+
+	err := conn.Serve(ctx, func(addr net.Addr, payload []byte) {
+		...
+	})
+
+Or receive packets through a channel, so they can be handled in a select
+statement alongside timers. A policy decides whether packets are dropped
+when the channel is full. Dropped packets are counted by Dropped:
+
+	in := conn.Incoming(64, xudp.DropOldest)
+	...
+	case packet := <-in:
+		...
+		packet.Release()
 */
 package xudp
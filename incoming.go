@@ -0,0 +1,144 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import "net"
+
+// A Policy determines what Incoming does with a received packet when
+// the channel's buffer is full.
+type Policy int
+
+// Known policies.
+const (
+	// Wait until the buffer has room. No packets are dropped, but the
+	// socket is not read in the mean time. The operating system drops
+	// packets once its own buffers fill up.
+	Block Policy = iota
+
+	// Drop the packet which was just received.
+	DropNewest
+
+	// Drop the oldest packet in the buffer, to make room for the packet
+	// which was just received.
+	DropOldest
+)
+
+// Incoming receives packets in a new goroutine and yields them through
+// the returned channel. The channel holds up to bufSize packets. The given
+// policy determines what happens to packets which arrive while it is full.
+// Packets without any payload are not yielded.
+//
+// The channel is closed when the connection is closed, or when receiving
+// fails. A read deadline which passes, does not close it. Packets are
+// received again once the deadline is moved. Receivers should call
+// Release on each packet once they are done with it, so its buffer can
+// be reused.
+//
+// This allows packets to be received in a select statement, alongside
+// timers and other channels:
+//
+//	in := conn.Incoming(64, xudp.DropOldest)
+//
+//	for {
+//		select {
+//		case p, ok := <-in:
+//			...
+//			p.Release()
+//		case <-tick.C:
+//			...
+//		}
+//	}
+func (c *Connection) Incoming(bufSize int, policy Policy) <-chan Packet {
+	ch := make(chan Packet, bufSize)
+	s := c.socket()
+
+	if s == nil {
+		close(ch)
+		return ch
+	}
+
+	go c.incoming(s, ch, policy)
+	return ch
+}
+
+// Dropped returns the number of packets which have been dropped because
+// the buffer of a channel returned by Incoming, or of a Listener's
+// session, was full.
+func (c *Connection) Dropped() int64 { return c.dropped.Load() }
+
+// incoming receives packets into ch until receiving fails.
+func (c *Connection) incoming(s *socket, ch chan Packet, policy Policy) {
+	defer close(ch)
+
+	var p Packet
+
+	for {
+		err := c.recvPacket(&p)
+
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// Wait for the host to move the read deadline.
+			select {
+			case <-s.rd.expired():
+				continue
+			case <-s.closed:
+				err = ErrConnectionectionClosed
+			}
+		}
+
+		if err != nil {
+			p.Release()
+			return
+		}
+
+		if len(p.Payload) == 0 {
+			continue // Reuse the buffer.
+		}
+
+		if !c.deliver(s, ch, p, policy) {
+			return
+		}
+
+		p = Packet{}
+	}
+}
+
+// deliver puts p into ch according to the given policy.
+// Returns false if the connection was closed while blocking.
+func (c *Connection) deliver(s *socket, ch chan Packet, p Packet, policy Policy) bool {
+	switch policy {
+	case DropNewest:
+		select {
+		case ch <- p:
+		default:
+			p.Release()
+			c.dropped.Add(1)
+		}
+
+	case DropOldest:
+		for {
+			select {
+			case ch <- p:
+				return true
+			default:
+			}
+
+			select {
+			case old := <-ch:
+				old.Release()
+				c.dropped.Add(1)
+			default:
+			}
+		}
+
+	default:
+		select {
+		case ch <- p:
+		case <-s.closed:
+			p.Release()
+			return false
+		}
+	}
+
+	return true
+}
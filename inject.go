@@ -0,0 +1,122 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import "net"
+
+// Values of the flag byte which precedes the payload while a Controller
+// is registered.
+const (
+	flagData    = 0
+	flagControl = 1
+)
+
+// Number of control packets which may wait to be sent. Further calls
+// to Inject fail with ErrQueueFull.
+const injectBacklog = 64
+
+// injected is a control packet waiting to be sent.
+type injected struct {
+	addr net.Addr
+	buf  *[]byte // Borrowed from the connection.
+	size int     // Size of the payload in buf.
+}
+
+// injector hands control packets from plugins to their connection.
+type injector struct {
+	conn *Connection
+}
+
+func (in injector) Inject(addr net.Addr, payload []byte) error {
+	return in.conn.inject(addr, payload)
+}
+
+// setInjector passes the injector to p, if it is a Controller.
+// A nil connection unsets it.
+func setInjector(p Plugin, c *Connection) {
+	ctl, ok := p.(Controller)
+
+	if !ok {
+		return
+	}
+
+	if c == nil {
+		ctl.SetInjector(nil)
+	} else {
+		ctl.SetInjector(injector{c})
+	}
+}
+
+// inject queues a control packet for the sender goroutine.
+func (c *Connection) inject(addr net.Addr, payload []byte) error {
+	s := c.socket()
+
+	if s == nil {
+		return ErrConnectionectionClosed
+	}
+
+	addr, err := s.target(addr)
+
+	if err != nil {
+		return err
+	}
+
+	if len(payload) > c.PayloadSize() {
+		return ErrPacketSize
+	}
+
+	buf := c.buffers.Get().(*[]byte)
+	ip := injected{addr: addr, buf: buf, size: copy(*buf, payload)}
+
+	select {
+	case s.inject <- ip:
+		return nil
+	case <-s.closed:
+		c.buffers.Put(buf)
+		return ErrConnectionectionClosed
+	default:
+		c.buffers.Put(buf)
+		return ErrQueueFull
+	}
+}
+
+// sendInjected sends queued control packets until the connection closes.
+// Packets which are still queued at that time are dropped.
+func (c *Connection) sendInjected(s *socket) {
+	buf := c.buffers.Get().(*[]byte)
+	defer c.buffers.Put(buf)
+
+	for {
+		select {
+		case ip := <-s.inject:
+			b, err := c.build(s, *buf, ip.addr, (*ip.buf)[:ip.size], true)
+
+			if err == nil {
+				s.writeTo(b, ip.addr, nil)
+			}
+
+			c.buffers.Put(ip.buf)
+
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// controlSize returns the size of the flag byte which marks control
+// packets, or 0 if neither a Controller nor a ControlReader which needs
+// it is registered.
+func (pl PluginList) controlSize() int {
+	for _, plg := range pl {
+		if _, ok := plg.(Controller); ok {
+			return 1
+		}
+
+		if cr, ok := plg.(ControlReader); ok && cr.ReadsControl() {
+			return 1
+		}
+	}
+
+	return 0
+}
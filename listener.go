@@ -0,0 +1,371 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of new sessions which may wait to be accepted. Packets from
+	// new peers are dropped while the backlog is full.
+	acceptBacklog = 32
+
+	// Number of packets which may wait to be read from a session. Further
+	// packets from the same peer are dropped.
+	sessionBacklog = 64
+)
+
+var (
+	_ net.Listener = (*Listener)(nil)
+	_ net.Conn     = (*Session)(nil)
+)
+
+// A Listener receives packets on a single connection and hands them to
+// a separate Session for each remote peer.
+//
+// Peers are told apart by their address. If a registered plugin
+// implements Keyer, peers are told apart by the key it reports instead.
+type Listener struct {
+	conn     *Connection
+	accept   chan *Session
+	done     chan struct{} // Closed when the listener stops.
+	once     sync.Once
+	mu       sync.Mutex // Guards the fields below.
+	sessions map[peerKey]*Session
+	err      error // Reason the listener stopped.
+}
+
+// Listen opens a connection on the given local address and returns a
+// listener for it.
+//
+// The network must be "udp", "udp4" or "udp6". The given plugins are
+// registered and opened along with the connection.
+func Listen(network, laddr string, mtu uint32, plugins ...Plugin) (*Listener, error) {
+	c := New(mtu)
+
+	for _, plg := range plugins {
+		err := c.Register(plg)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := c.OpenAddr(network, laddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		conn:     c,
+		accept:   make(chan *Session, acceptBacklog),
+		done:     make(chan struct{}),
+		sessions: make(map[peerKey]*Session),
+	}
+
+	go l.run(c.socket())
+	return l, nil
+}
+
+// Conn returns the underlying connection. It can be used to access the
+// plugins, or to send packets to peers which have no session.
+func (l *Listener) Conn() *Connection { return l.conn }
+
+// Addr returns the listener's local network address.
+func (l *Listener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+// Accept waits for a packet from a new peer and returns a session for it.
+// It implements net.Listener. See AcceptSession.
+func (l *Listener) Accept() (net.Conn, error) {
+	s, err := l.AcceptSession()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// AcceptSession waits for a packet from a new peer and returns a session
+// for it. The packet can be read from the session.
+func (l *Listener) AcceptSession() (*Session, error) {
+	select {
+	case s := <-l.accept:
+		return s, nil
+	case <-l.done:
+		return nil, l.stopError()
+	}
+}
+
+// Close closes the listener, its connection and all of its sessions.
+func (l *Listener) Close() error {
+	err := l.conn.Close()
+	l.stop(ErrConnectionectionClosed)
+	return err
+}
+
+// run receives packets and hands them to sessions, until receiving fails.
+func (l *Listener) run(s *socket) {
+	c := l.conn
+	var p Packet
+
+	for {
+		if p.buf == nil {
+			p.buf = c.buffers.Get().(*[]byte)
+			p.conn = c
+		}
+
+		size, addr, err := c.readFrom(s, *p.buf, nil)
+
+		if err != nil {
+			p.Release()
+			l.stop(closedError(err))
+			return
+		}
+
+		var key string
+		payload, err := c.process(s, addr, (*p.buf)[:size], &key)
+
+		if err == ErrConnectionectionClosed {
+			p.Release()
+			l.stop(err)
+			return
+		}
+
+		if err != nil || len(payload) == 0 {
+			continue // Reuse the buffer.
+		}
+
+		p.Addr = addr
+		p.Payload = payload
+
+		k := keyOf(addr)
+
+		if len(key) > 0 {
+			k = peerKey{str: key}
+		}
+
+		if l.deliver(k, p) {
+			p = Packet{}
+		} else {
+			c.dropped.Add(1)
+		}
+	}
+}
+
+// deliver hands p to the session for the given key. A new session is
+// created if there is none. Returns false if the packet was dropped.
+func (l *Listener) deliver(key peerKey, p Packet) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return false
+	}
+
+	s, ok := l.sessions[key]
+
+	if !ok {
+		s = newSession(l, key, p.Addr)
+
+		select {
+		case l.accept <- s:
+			l.sessions[key] = s
+		default:
+			return false // Backlog is full.
+		}
+	}
+
+	s.setRemoteAddr(p.Addr)
+
+	select {
+	case s.in <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop shuts the listener down and closes all sessions.
+func (l *Listener) stop(err error) {
+	l.once.Do(func() {
+		l.mu.Lock()
+		l.err = err
+		sessions := l.sessions
+		l.sessions = nil
+		l.mu.Unlock()
+
+		close(l.done)
+
+		for _, s := range sessions {
+			s.shutdown()
+		}
+	})
+}
+
+// stopError returns the reason the listener stopped.
+func (l *Listener) stopError() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// remove forgets the given session, so the next packet from its peer
+// starts a new one.
+func (l *Listener) remove(s *Session) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sessions[s.key] == s {
+		delete(l.sessions, s.key)
+	}
+}
+
+// A Session exchanges packets with a single peer of a Listener.
+// It implements net.Conn. Each Read yields the payload of one packet and
+// each Write sends one packet.
+type Session struct {
+	l     *Listener
+	key   peerKey
+	in    chan Packet
+	rd    deadline
+	wd    deadline
+	done  chan struct{} // Closed when the session closes.
+	once  sync.Once
+	mu    sync.Mutex // Guards raddr.
+	raddr net.Addr
+}
+
+func newSession(l *Listener, key peerKey, addr net.Addr) *Session {
+	return &Session{
+		l:     l,
+		key:   key,
+		in:    make(chan Packet, sessionBacklog),
+		rd:    makeDeadline(),
+		wd:    makeDeadline(),
+		done:  make(chan struct{}),
+		raddr: addr,
+	}
+}
+
+// Read receives the payload of the next packet from the peer into b.
+//
+// If b is too small to hold the payload, it is filled with as much data
+// as fits and io.ErrShortBuffer is returned.
+func (s *Session) Read(b []byte) (int, error) {
+	if isClosed(s.done) {
+		return 0, ErrConnectionectionClosed
+	}
+
+	if isClosed(s.rd.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	select {
+	case p := <-s.in:
+		n := copy(b, p.Payload)
+		short := n < len(p.Payload)
+		p.Release()
+
+		if short {
+			return n, io.ErrShortBuffer
+		}
+
+		return n, nil
+
+	case <-s.done:
+		return 0, ErrConnectionectionClosed
+	case <-s.rd.wait():
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Write sends b as a single packet to the peer.
+func (s *Session) Write(b []byte) (int, error) {
+	if isClosed(s.done) {
+		return 0, ErrConnectionectionClosed
+	}
+
+	if isClosed(s.wd.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	err := s.l.conn.Send(s.RemoteAddr(), b)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Close closes the session. Packets from the peer which arrive after
+// this, start a new session. The listener remains open.
+func (s *Session) Close() error {
+	if isClosed(s.done) {
+		return ErrConnectionectionClosed
+	}
+
+	s.l.remove(s)
+	s.shutdown()
+	return nil
+}
+
+// shutdown marks the session as closed and releases pending packets.
+func (s *Session) shutdown() {
+	s.once.Do(func() { close(s.done) })
+
+	for {
+		select {
+		case p := <-s.in:
+			p.Release()
+		default:
+			return
+		}
+	}
+}
+
+// LocalAddr returns the listener's local network address.
+func (s *Session) LocalAddr() net.Addr { return s.l.Addr() }
+
+// RemoteAddr returns the address of the peer. If the session is keyed by
+// a Keyer, this is the address of the most recent packet from the peer.
+func (s *Session) RemoteAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.raddr
+}
+
+func (s *Session) setRemoteAddr(addr net.Addr) {
+	s.mu.Lock()
+	s.raddr = addr
+	s.mu.Unlock()
+}
+
+// SetDeadline sets the read and write deadlines for the session.
+func (s *Session) SetDeadline(t time.Time) error {
+	s.rd.set(t)
+	s.wd.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for pending and future Read calls.
+// A zero value for t means Read will not time out.
+func (s *Session) SetReadDeadline(t time.Time) error {
+	s.rd.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls.
+// A zero value for t means Write will not time out.
+func (s *Session) SetWriteDeadline(t time.Time) error {
+	s.wd.set(t)
+	return nil
+}
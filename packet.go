@@ -0,0 +1,112 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Pool of Packet values returned by Connection.RecvPacket.
+var packets = sync.Pool{
+	New: func() interface{} { return new(Packet) },
+}
+
+// A Packet holds the payload of a single datagram, along with the
+// address of the remote end point.
+//
+// Packets filled in by a connection borrow one of its internal buffers.
+// Call Release once the payload is no longer needed, to return the buffer
+// to the connection. The payload must not be used after that.
+type Packet struct {
+	Addr    net.Addr    // Address of the remote end point.
+	Payload []byte      // Payload data, without any plugin headers.
+	buf     *[]byte     // Borrowed packet buffer.
+	conn    *Connection // Connection which owns buf.
+	pooled  bool        // Packet itself came from the packet pool.
+}
+
+// Release returns the packet's buffer to the connection it came from.
+// Packets obtained from RecvPacket are themselves returned to a pool
+// and must not be used after this call.
+func (p *Packet) Release() {
+	if p.buf != nil {
+		p.conn.buffers.Put(p.buf)
+	}
+
+	pooled := p.pooled
+	*p = Packet{}
+
+	if pooled {
+		packets.Put(p)
+	}
+}
+
+// RecvPacket receives a new packet. This is a blocking operation.
+//
+// The returned packet is taken from a pool and its payload refers to one
+// of the connection's buffers. No memory is allocated. The caller must
+// call Release on it when done.
+func (c *Connection) RecvPacket() (*Packet, error) {
+	p := packets.Get().(*Packet)
+	p.pooled = true
+
+	err := c.recvPacket(p)
+
+	if err != nil {
+		p.Release()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// recvPacket receives a new packet into p. It borrows a buffer from
+// the connection if p does not already hold one.
+func (c *Connection) recvPacket(p *Packet) (err error) {
+	s := c.socket()
+
+	if s == nil {
+		return ErrConnectionectionClosed
+	}
+
+	if p.buf == nil {
+		p.buf = c.buffers.Get().(*[]byte)
+		p.conn = c
+	}
+
+	p.Addr, p.Payload, err = c.recv(s, *p.buf, nil)
+	return
+}
+
+// RecvInto receives a new payload and copies it into buf.
+// This is a blocking operation. It returns the number of bytes copied.
+//
+// If buf is too small to hold the payload, it is filled with as much
+// data as fits and io.ErrShortBuffer is returned.
+func (c *Connection) RecvInto(buf []byte) (addr net.Addr, n int, err error) {
+	s := c.socket()
+
+	if s == nil {
+		return nil, 0, ErrConnectionectionClosed
+	}
+
+	b := c.buffers.Get().(*[]byte)
+	defer c.buffers.Put(b)
+
+	addr, payload, err := c.recv(s, *b, nil)
+
+	if err != nil {
+		return
+	}
+
+	n = copy(buf, payload)
+
+	if n < len(payload) {
+		err = io.ErrShortBuffer
+	}
+
+	return
+}
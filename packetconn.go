@@ -0,0 +1,127 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// NewFromPacketConn creates a connection on top of an existing socket.
+// This can be a socket created by another library, or one inherited
+// from the parent process. See ListenFDs.
+//
+// The given plugins are registered and opened, as if Open had been
+// called. If the socket is a connected *net.UDPConn, the connection
+// behaves as if it had been created with Dial.
+//
+// The socket is closed along with the connection. Call SetKeepOpen
+// to leave it open instead. If an error is returned, the socket is not
+// closed and remains owned by the caller.
+func NewFromPacketConn(pc net.PacketConn, mtu uint32, plugins ...Plugin) (*Connection, error) {
+	c := New(mtu)
+
+	for _, plg := range plugins {
+		err := c.Register(plg)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var raddr net.Addr
+	if uc, ok := pc.(*net.UDPConn); ok {
+		raddr = uc.RemoteAddr()
+	}
+
+	err := c.open(pc, raddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// SetKeepOpen determines whether Close leaves the underlying socket open.
+// This is useful when the socket is owned by someone else.
+//
+// Note that Close does not interrupt pending Recv calls on a socket which
+// is left open. These complete when the next packet arrives or the
+// socket's owner closes it.
+func (c *Connection) SetKeepOpen(keep bool) {
+	c.mu.Lock()
+	c.keepOpen = keep
+	c.mu.Unlock()
+}
+
+// The first file descriptor passed on by systemd socket activation.
+const listenFDsStart = 3
+
+// ListenFDs returns the sockets passed to this process through systemd
+// socket activation. It reads the LISTEN_PID, LISTEN_FDS and
+// LISTEN_FDNAMES environment variables. Returns nil if these do not
+// address the current process.
+//
+// All passed descriptors must be datagram sockets. The environment
+// variables are cleared, so child processes do not inherit them.
+//
+// Each socket can be wrapped with NewFromPacketConn:
+//
+//	pcs, err := xudp.ListenFDs()
+//	...
+//	conn, err := xudp.NewFromPacketConn(pcs[0], MTU, plugins...)
+func ListenFDs() ([]net.PacketConn, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	list := make([]net.PacketConn, 0, count)
+
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+
+		if i := fd - listenFDsStart; i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		pc, err := net.FilePacketConn(file)
+		file.Close()
+
+		if err != nil {
+			for _, pc := range list {
+				pc.Close()
+			}
+
+			// Nobody else will claim the remaining descriptors, now that
+			// the environment is cleared.
+			for rest := fd + 1; rest < listenFDsStart+count; rest++ {
+				os.NewFile(uintptr(rest), "").Close()
+			}
+
+			return nil, fmt.Errorf("socket %s: %v", name, err)
+		}
+
+		list = append(list, pc)
+	}
+
+	return list, nil
+}
@@ -0,0 +1,148 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPeerTimeout is the time after which the state plugins keep for
+// an idle peer is released.
+const DefaultPeerTimeout = time.Minute
+
+// SetPeerTimeout sets the time after which the state plugins keep for an
+// idle peer is released. A peer is idle if no packets have been sent to
+// or received from it. A value of zero keeps the state until the
+// connection closes. The default is DefaultPeerTimeout.
+func (c *Connection) SetPeerTimeout(d time.Duration) {
+	c.peers.mu.Lock()
+	c.peers.timeout = d
+	c.peers.mu.Unlock()
+
+	if s := c.socket(); s != nil {
+		s.sched.kick()
+	}
+}
+
+// peerTable holds the state of PeerPlugins for all known peers.
+type peerTable struct {
+	mu      sync.Mutex
+	peers   map[peerKey]*peer
+	timeout time.Duration // Idle time after which a peer is evicted.
+	swept   time.Time     // Time of the last sweep for idle peers.
+	clock   Clock         // Tells the time at which a peer is used.
+}
+
+// get returns the peer with the given address, creating it if necessary.
+func (t *peerTable) get(addr net.Addr) *peer {
+	key := keyOf(addr)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.peers[key]
+
+	if !ok {
+		if t.peers == nil {
+			t.peers = make(map[peerKey]*peer)
+		}
+
+		p = &peer{addr: addr}
+		t.peers[key] = p
+	}
+
+	p.seen.Store(t.clock.Now().UnixNano())
+	return p
+}
+
+// evict releases the state of peers which have been idle for too long.
+// Peers are checked twice per timeout. Returns the time at which evict
+// should be called again, or the zero time if peers never time out.
+func (t *peerTable) evict(now time.Time) time.Time {
+	t.mu.Lock()
+
+	if t.timeout <= 0 {
+		t.mu.Unlock()
+		return time.Time{}
+	}
+
+	var idle []*peer
+
+	if now.Sub(t.swept) >= t.timeout/2 {
+		t.swept = now
+
+		for key, p := range t.peers {
+			if now.UnixNano()-p.seen.Load() > int64(t.timeout) {
+				delete(t.peers, key)
+				idle = append(idle, p)
+			}
+		}
+	}
+
+	next := t.swept.Add(t.timeout / 2)
+	t.mu.Unlock()
+
+	for _, p := range idle {
+		p.close()
+	}
+
+	return next
+}
+
+// clear removes all peers and releases their state.
+func (t *peerTable) clear() {
+	t.mu.Lock()
+	peers := t.peers
+	t.peers = nil
+	t.mu.Unlock()
+
+	for _, p := range peers {
+		p.close()
+	}
+}
+
+// peer holds the state of all PeerPlugins for a single peer.
+type peer struct {
+	addr   net.Addr
+	seen   atomic.Int64 // Time at which the peer was last used.
+	mu     sync.Mutex   // Guards states.
+	states []peerState
+}
+
+// peerState holds the state of a single plugin.
+type peerState struct {
+	plugin PeerPlugin
+	state  interface{}
+}
+
+// state returns the state of the given plugin, creating it if necessary.
+func (p *peer) state(plg PeerPlugin) interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, ps := range p.states {
+		if ps.plugin == plg {
+			return ps.state
+		}
+	}
+
+	state := plg.NewPeer(p.addr)
+	p.states = append(p.states, peerState{plg, state})
+	return state
+}
+
+// close releases the state of all plugins.
+func (p *peer) close() {
+	p.mu.Lock()
+	states := p.states
+	p.states = nil
+	p.mu.Unlock()
+
+	for _, ps := range states {
+		ps.plugin.ClosePeer(p.addr, ps.state)
+	}
+}
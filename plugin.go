@@ -3,10 +3,16 @@
 
 package xudp
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
 // A Plugin can be registered with a connection to add
 // a unique feature to a packet connection.
+//
+// The order in which plugins process packets is determined by their
+// Stage and the order in which they were registered.
 type Plugin interface {
 	// Returns the size in bytes of any data added to the packet
 	// by the given plugin.
@@ -17,15 +23,228 @@ type Plugin interface {
 
 	// Called when a new packet is being sent.
 	//
-	// It accepts the target address, the full packet which includes the
-	// plugin/header data with payload and the index at which the actual
+	// It accepts the target address, the packet starting at this plugin's
+	// header data and the index in that slice at which the actual
 	// payload starts.
+	//
+	// The packet buffer is reused once the call returns. Plugins must
+	// copy any data they wish to retain.
 	Send(net.Addr, []byte, int) error
 
 	// Called when a new packet is received.
 	//
-	// It accepts the source address, the full packet which includes the
-	// plugin/header data and the payload and the index at which the actual
+	// It accepts the source address, the packet starting at this plugin's
+	// header data and the index in that slice at which the actual
 	// payload starts.
+	//
+	// The packet buffer is reused once the call returns. Plugins must
+	// copy any data they wish to retain.
 	Recv(net.Addr, []byte, int) error
 }
+
+// A VarPlugin is a Plugin whose header size may differ from one packet
+// to the next. This allows for optional fields, variable length integers
+// and other compact encodings.
+//
+// Its PayloadSize method returns the largest header it can produce.
+// The connection reserves this much space when computing the maximum
+// payload size. The plugin's Send method is not called.
+type VarPlugin interface {
+	Plugin
+
+	// Called when a new packet is being sent, instead of Send.
+	//
+	// It accepts the same arguments as Send. The plugin writes its header
+	// at the start of the packet slice, which has room for at least
+	// PayloadSize() bytes. It returns the number of header bytes it has
+	// actually written.
+	SendVar(net.Addr, []byte, int) (int, error)
+
+	// Called when a new packet is received, before the Recv method of
+	// any plugin is called.
+	//
+	// It accepts the received packet, starting at this plugin's header
+	// data. It returns the number of bytes consumed by the header. This
+	// tells the connection where the next header and the payload start.
+	// Return ErrDiscard to drop the packet. Headers which are larger than
+	// PayloadSize() are dropped as well.
+	HeaderSize([]byte) (int, error)
+}
+
+// A TrailerPlugin is a Plugin which appends data after the payload.
+// Checksums and message authentication codes are typical examples.
+//
+// A trailer covers the plugin's own header, along with the headers,
+// payload and trailers of all plugins inside it. When a packet is sent,
+// the trailer is written after the plugin's Send method is called. When
+// a packet is received, it is verified and stripped before the Recv
+// method of the plugin or any plugin inside it is called.
+type TrailerPlugin interface {
+	Plugin
+
+	// Returns the size in bytes of the trailer added to the packet.
+	TrailerSize() int
+
+	// Called when a new packet is being sent.
+	//
+	// It accepts the target address, the packet from the start of this
+	// plugin's header and the TrailerSize() bytes directly following it,
+	// which must be filled in.
+	SendTrailer(addr net.Addr, packet, trailer []byte) error
+
+	// Called when a new packet is received.
+	//
+	// It accepts the source address, the packet from the start of this
+	// plugin's header up to its trailer and the trailer itself. Return
+	// ErrDiscard to drop the packet.
+	RecvTrailer(addr net.Addr, packet, trailer []byte) error
+}
+
+// A Transformer is a Plugin which replaces the packet contents with new
+// data, which may differ in size. Compression, encryption and padding are
+// typical examples.
+//
+// A transformer encodes everything inside its own layer: the headers,
+// payload and trailers of all plugins at later stages, or registered
+// after it. This happens before its own header and trailer are written.
+// Incoming data is decoded after the plugin's Recv method is called.
+// To the transformer and the plugins outside of it, the encoded data
+// takes the place of the payload.
+type Transformer interface {
+	Plugin
+
+	// Returns the maximum number of bytes by which Encode can grow
+	// a payload. The connection reserves this much space when computing
+	// the maximum payload size.
+	Overhead() int
+
+	// Called when a new packet is being sent.
+	//
+	// It accepts the target address, a destination buffer and the data to
+	// encode. The encoded data is written to dst and its size is returned.
+	// The destination buffer never overlaps the source.
+	Encode(addr net.Addr, dst, src []byte) (int, error)
+
+	// Called when a new packet is received.
+	//
+	// It accepts the source address, a destination buffer and the encoded
+	// data. The decoded data is written to dst and its size is returned.
+	// Return ErrDiscard to drop the packet.
+	Decode(addr net.Addr, dst, src []byte) (int, error)
+}
+
+// A Keyer is a Plugin which can tell peers apart by something other than
+// their address. A Listener uses it to assign packets to sessions.
+type Keyer interface {
+	Plugin
+
+	// Called after the plugin's Recv method has accepted a packet.
+	//
+	// It accepts the source address and the packet starting at this
+	// plugin's header data. It returns a key which uniquely identifies
+	// the peer which sent the packet.
+	PeerKey(addr net.Addr, packet []byte) string
+}
+
+// A PeerKeyer is a Keyer which keeps separate state for each peer. It can
+// cache the key in that state, rather than derive it from every packet.
+type PeerKeyer interface {
+	Keyer
+	PeerPlugin
+
+	// Called instead of PeerKey, with the peer's state.
+	PeerStateKey(peer interface{}, addr net.Addr, packet []byte) string
+}
+
+// A PeerPlugin is a Plugin which keeps separate state for each peer it
+// exchanges packets with, such as sequence numbers. The connection stores
+// this state and hands it to the plugin with every packet. The plugin's
+// Send and Recv methods are not called.
+//
+// State is created when the first packet for a peer is sent or received.
+// It is released when the peer has been idle for some time, or when the
+// connection closes. See Connection.SetPeerTimeout.
+type PeerPlugin interface {
+	Plugin
+
+	// Creates the state for a new peer.
+	NewPeer(addr net.Addr) interface{}
+
+	// Called when the state for a peer is no longer used.
+	ClosePeer(addr net.Addr, peer interface{})
+
+	// Called when a new packet is being sent, instead of Send.
+	//
+	// It accepts the peer's state, along with the same arguments as Send.
+	// It returns the number of header bytes it has written. Plugins which
+	// may write fewer than PayloadSize() bytes, must also implement the
+	// HeaderSize method described by VarPlugin.
+	SendPeer(peer interface{}, addr net.Addr, b []byte, index int) (int, error)
+
+	// Called when a new packet is received, instead of Recv.
+	//
+	// It accepts the peer's state, along with the same arguments as Recv.
+	RecvPeer(peer interface{}, addr net.Addr, b []byte, index int) error
+}
+
+// An Injector sends control packets on behalf of a plugin. Control packets
+// pass through all registered plugins, just like any other packet, but
+// their payload is never handed to the host.
+type Injector interface {
+	// Queues a control packet with the given payload for the given
+	// address. The payload is copied, so the caller may reuse it once
+	// the call returns. Returns ErrQueueFull if too many control packets
+	// are waiting to be sent.
+	Inject(addr net.Addr, payload []byte) error
+}
+
+// A Controller is a Plugin which originates packets of its own, such as
+// acknowledgements or keepalives, when the host has nothing to send.
+//
+// While a Controller is registered, every packet carries a single flag
+// byte directly in front of the payload, which tells control packets
+// apart from application data. It counts towards the maximum payload size.
+type Controller interface {
+	Plugin
+
+	// Called with the connection's injector when the plugin is registered,
+	// and with nil when it is unregistered.
+	SetInjector(Injector)
+}
+
+// A ControlReader is a Plugin which tells control packets apart from
+// application data, but sends no packets of its own. While it is
+// registered, packets carry the same flag byte as with a Controller.
+type ControlReader interface {
+	Plugin
+
+	// Returns true if the plugin needs the flag byte. The answer must not
+	// change while the plugin is registered.
+	ReadsControl() bool
+}
+
+// IsControl returns true if the given packet, as passed to a plugin's
+// Send or Recv method along with the index of its payload, is a control
+// packet. This is only meaningful while a Controller or ControlReader is
+// registered. It
+// does not work for plugins outside of a Transformer, since those see the
+// encoded data in place of the payload.
+func IsControl(b []byte, index int) bool {
+	return index > 0 && index <= len(b) && b[index-1] == flagControl
+}
+
+// A Ticker is a Plugin which needs to do work at regular intervals, such
+// as expiring timeouts. While the connection is open, it calls Tick for
+// all registered tickers from a single scheduler. Ticks for a plugin never
+// overlap.
+type Ticker interface {
+	Plugin
+
+	// Returns the time between two calls to Tick. A value of zero or less
+	// means the plugin is not ticked.
+	TickInterval() time.Duration
+
+	// Called once every interval. It accepts the current time, as told by
+	// the connection's Clock.
+	Tick(now time.Time)
+}
@@ -3,6 +3,11 @@
 
 package xudp
 
+import "net"
+
+// A PluginList holds plugins in the order in which they process received
+// packets: by stage, then by order of registration. Outgoing packets are
+// processed in reverse order.
 type PluginList []Plugin
 
 // Contains returns the index of the plugin in the list.
@@ -31,14 +36,67 @@ func (pl PluginList) PayloadSize() int {
 	return size
 }
 
+// headerSizes appends the payload size of each plugin to sizes and
+// returns it, along with their sum. Plugins may change their size at any
+// time, so a packet is built with a single snapshot of the sizes.
+func (pl PluginList) headerSizes(sizes []int) ([]int, int) {
+	var total int
+
+	for _, plg := range pl {
+		size := plg.PayloadSize()
+		sizes = append(sizes, size)
+		total += size
+	}
+
+	return sizes, total
+}
+
+// TrailerSize returns the combined trailer size for all plugins.
+func (pl PluginList) TrailerSize() int {
+	var size int
+
+	for _, plg := range pl {
+		if tp, ok := plg.(TrailerPlugin); ok {
+			size += tp.TrailerSize()
+		}
+	}
+
+	return size
+}
+
+// Overhead returns the combined transformer overhead for all plugins.
+func (pl PluginList) Overhead() int {
+	var size int
+
+	for _, plg := range pl {
+		if tf, ok := plg.(Transformer); ok {
+			size += tf.Overhead()
+		}
+	}
+
+	return size
+}
+
 // Clear removes all plugins.
 func (pl *PluginList) Clear() { *pl = nil }
 
-// Register registers the given plugin.
+// Register registers the given plugin. It is placed after all plugins
+// of the same or an earlier stage.
 func (pl *PluginList) Register(p Plugin) {
-	if !pl.Contains(p) {
-		*pl = append(*pl, p)
+	if pl.Contains(p) {
+		return
+	}
+
+	stage := StageOf(p)
+	idx := len(*pl)
+
+	for idx > 0 && StageOf((*pl)[idx-1]) > stage {
+		idx--
 	}
+
+	*pl = append(*pl, nil)
+	copy((*pl)[idx+1:], (*pl)[idx:])
+	(*pl)[idx] = p
 }
 
 // Unregister removes the given plugin from the connection.
@@ -53,3 +111,273 @@ func (pl *PluginList) Unregister(p Plugin) {
 	t = append(t, (*pl)[idx+1:]...)
 	*pl = t
 }
+
+// send passes an outgoing packet through all plugins, from the innermost
+// to the outermost.
+//
+// The payload is found in b[inner:end]. It may be preceded by the flag
+// which marks control packets, in which case start is the flag's offset.
+// The space before start is large enough for the headers of the given
+// sizes, as returned by headerSizes, and the space after end for all
+// trailers and transformer overhead. Each
+// plugin wraps the packet built so far in its own header and trailer.
+// A transformer first replaces it with the encoded version. Returns the
+// bounds of the finished packet in b.
+func (pl PluginList) send(ps *pass, b []byte, sizes []int, start, inner, end int) (int, int, error) {
+	addr := ps.addr
+	payload, pend := inner, end // Payload as seen by the current plugin.
+
+	for i := len(pl) - 1; i >= 0; i-- {
+		plg := pl[i]
+
+		if tf, ok := plg.(Transformer); ok {
+			dst := ps.scratch()
+			n, err := tf.Encode(addr, dst, b[start:end])
+
+			if err != nil {
+				return 0, 0, err
+			}
+
+			if n < 0 || n > len(dst) || start+n > len(b) {
+				return 0, 0, ErrPacketSize
+			}
+
+			end = start + copy(b[start:], dst[:n])
+			payload, pend = start, end
+		}
+
+		size := sizes[i]
+
+		if pp, ok := plg.(PeerPlugin); ok {
+			n, err := pp.SendPeer(ps.state(pp), addr, b[start-size:pend], payload-start+size)
+
+			if err != nil {
+				return 0, 0, err
+			}
+
+			if n < 0 || n > size {
+				return 0, 0, ErrHeaderSize
+			}
+
+			copy(b[start-n:start], b[start-size:start-size+n])
+			start -= n
+		} else if vp, ok := plg.(VarPlugin); ok {
+			n, err := vp.SendVar(addr, b[start-size:pend], payload-start+size)
+
+			if err != nil {
+				return 0, 0, err
+			}
+
+			if n < 0 || n > size {
+				return 0, 0, ErrHeaderSize
+			}
+
+			copy(b[start-n:start], b[start-size:start-size+n])
+			start -= n
+		} else {
+			start -= size
+			err := plg.Send(addr, b[start:pend], payload-start)
+
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		if tp, ok := plg.(TrailerPlugin); ok {
+			size := tp.TrailerSize()
+
+			if end+size > len(b) {
+				return 0, 0, ErrPacketSize
+			}
+
+			err := tp.SendTrailer(addr, b[start:end], b[end:end+size])
+
+			if err != nil {
+				return 0, 0, err
+			}
+
+			end += size
+		}
+	}
+
+	return start, end, nil
+}
+
+// recv passes an incoming packet through all plugins, from the outermost
+// to the innermost.
+//
+// Plugins are handled in groups which end at a transformer. The header
+// sizes within a group are determined first, so each plugin can be told
+// where the payload starts. The group's trailers are then verified and
+// stripped, before the plugins process their headers. Finally, the
+// transformer decodes the remainder of the packet in place.
+//
+// Returns the bounds of the payload in b, including the flag which marks
+// control packets, if any. The buffer underlying b may be written up to its
+// capacity. If ps.key is not nil, it receives the peer key reported by the
+// innermost Keyer, if any. Packets which are too short to hold all headers
+// and trailers, yield ErrDiscard.
+func (pl PluginList) recv(ps *pass, b []byte) (int, int, error) {
+	var offsets [16]int
+	addr := ps.addr
+	start, end := 0, len(b)
+	flag := pl.controlSize()
+
+	for len(pl) > 0 {
+		last := 0
+		for last < len(pl)-1 && !isTransformer(pl[last]) {
+			last++
+		}
+
+		group := pl[:last+1]
+		pl = pl[last+1:]
+
+		headers := offsets[:0]
+
+		for _, plg := range group {
+			size := plg.PayloadSize()
+
+			if hs, ok := plg.(headerSizer); ok && start <= end {
+				n, err := hs.HeaderSize(b[start:end])
+
+				if err != nil {
+					return 0, 0, err
+				}
+
+				if n < 0 {
+					return 0, 0, ErrHeaderSize
+				}
+
+				// The header was sent with other settings than the
+				// plugin uses now.
+				if n > size {
+					return 0, 0, ErrDiscard
+				}
+
+				size = n
+			}
+
+			headers = append(headers, start)
+			start += size
+		}
+
+		for i, plg := range group {
+			if tp, ok := plg.(TrailerPlugin); ok {
+				size := tp.TrailerSize()
+
+				if end-size < start {
+					return 0, 0, ErrDiscard // Not enough data.
+				}
+
+				err := tp.RecvTrailer(addr, b[headers[i]:end-size], b[end-size:end])
+
+				if err != nil {
+					return 0, 0, err
+				}
+
+				end -= size
+			}
+		}
+
+		// Plugins inside all transformers see the payload past the flag.
+		inner := start
+
+		if len(pl) == 0 && !isTransformer(group[last]) {
+			inner += flag
+		}
+
+		if inner > end {
+			return 0, 0, ErrDiscard // Not enough data.
+		}
+
+		for i, plg := range group {
+			var err error
+
+			if pp, ok := plg.(PeerPlugin); ok {
+				err = pp.RecvPeer(ps.state(pp), addr, b[headers[i]:end], inner-headers[i])
+			} else {
+				err = plg.Recv(addr, b[headers[i]:end], inner-headers[i])
+			}
+
+			if err != nil {
+				return 0, 0, err
+			}
+
+			if ps.key == nil {
+				continue
+			}
+
+			if kp, ok := plg.(PeerKeyer); ok {
+				*ps.key = kp.PeerStateKey(ps.state(kp), addr, b[headers[i]:end])
+			} else if kp, ok := plg.(Keyer); ok {
+				*ps.key = kp.PeerKey(addr, b[headers[i]:end])
+			}
+		}
+
+		if tf, ok := group[last].(Transformer); ok {
+			dst := ps.scratch()
+			n, err := tf.Decode(addr, dst, b[start:end])
+
+			if err != nil {
+				return 0, 0, err
+			}
+
+			if n < 0 || n > len(dst) || start+n > cap(b) {
+				return 0, 0, ErrDiscard
+			}
+
+			b = b[:start+n]
+			end = start + copy(b[start:], dst[:n])
+		}
+	}
+
+	return start, end, nil
+}
+
+// isTransformer returns true if p implements Transformer.
+func isTransformer(p Plugin) bool {
+	_, ok := p.(Transformer)
+	return ok
+}
+
+// headerSizer is implemented by plugins which can tell the size of their
+// header in a received packet. See VarPlugin.
+type headerSizer interface {
+	HeaderSize([]byte) (int, error)
+}
+
+// pass holds the state of a single packet on its way through the plugins.
+type pass struct {
+	conn *Connection
+	addr net.Addr // Address of the remote peer.
+	key  *string  // Receives the key reported by a Keyer; may be nil.
+	buf  *[]byte  // Scratch buffer for transformers; nil until needed.
+	peer *peer    // Per-peer plugin state; nil until needed.
+}
+
+// scratch returns a temporary buffer, borrowing it from the connection
+// if necessary.
+func (ps *pass) scratch() []byte {
+	if ps.buf == nil {
+		ps.buf = ps.conn.buffers.Get().(*[]byte)
+	}
+
+	return *ps.buf
+}
+
+// state returns the given plugin's state for the remote peer.
+func (ps *pass) state(p PeerPlugin) interface{} {
+	if ps.peer == nil {
+		ps.peer = ps.conn.peers.get(ps.addr)
+	}
+
+	return ps.peer.state(p)
+}
+
+// release returns the scratch buffer to the connection.
+func (ps *pass) release() {
+	if ps.buf != nil {
+		ps.conn.buffers.Put(ps.buf)
+		ps.buf = nil
+	}
+}
@@ -4,9 +4,18 @@
 package ident
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"github.com/jteeuwen/xudp"
 	"net"
+	"sync"
+)
+
+// The plugin caches the hash of each peer and lets an xudp.Listener tell
+// peers apart by it.
+var (
+	_ xudp.PeerPlugin = (*Plugin)(nil)
+	_ xudp.PeerKeyer  = (*Plugin)(nil)
 )
 
 type PeerFunc func(hash PeerHash, addr net.Addr, payload []byte)
@@ -46,20 +55,63 @@ func (c *Plugin) Open(port int) error {
 	return nil
 }
 
-func (p *Plugin) Send(addr net.Addr, payload []byte, index int) error {
-	copy(payload, p.id)
-	return nil
+// peer caches the peer hash for a single peer.
+type peer struct {
+	mu   sync.Mutex
+	id   [PeerHashSize]byte // Peer id from the most recent packet.
+	hash PeerHash           // Hash of the peer's address and id.
+}
+
+func (p *Plugin) NewPeer(addr net.Addr) interface{}          { return new(peer) }
+func (p *Plugin) ClosePeer(addr net.Addr, state interface{}) {}
+
+// Send and Recv are not called. Packets are handled by SendPeer and
+// RecvPeer instead.
+func (p *Plugin) Send(net.Addr, []byte, int) error { return nil }
+func (p *Plugin) Recv(net.Addr, []byte, int) error { return nil }
+
+func (p *Plugin) SendPeer(state interface{}, addr net.Addr, payload []byte, index int) (int, error) {
+	return copy(payload, p.id), nil
 }
 
-func (p *Plugin) Recv(addr net.Addr, payload []byte, index int) error {
+// RecvPeer calls the receive handler with the peer's hash.
+func (p *Plugin) RecvPeer(state interface{}, addr net.Addr, payload []byte, index int) error {
 	if p.onRecv == nil {
 		return nil
 	}
 
-	p.onRecv(NewPeerHash(addr, payload[:PeerHashSize]), addr, payload[index:])
+	hash := state.(*peer).hashOf(addr, payload[:PeerHashSize])
+	p.onRecv(hash, addr, payload[index:])
 	return nil
 }
 
+// PeerKey returns the peer hash for the given packet. This lets
+// an xudp.Listener keep a single session for a peer, even if its
+// public port changes.
+func (p *Plugin) PeerKey(addr net.Addr, payload []byte) string {
+	return string(NewPeerHash(addr, payload[:PeerHashSize]))
+}
+
+// PeerStateKey returns the peer hash for the given packet, like PeerKey.
+// The hash is cached in the peer's state.
+func (p *Plugin) PeerStateKey(state interface{}, addr net.Addr, payload []byte) string {
+	return string(state.(*peer).hashOf(addr, payload[:PeerHashSize]))
+}
+
+// hashOf returns the peer hash for the given id. The hash is only computed
+// again when the peer's id changes.
+func (pr *peer) hashOf(addr net.Addr, id []byte) PeerHash {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if len(pr.hash) == 0 || !bytes.Equal(pr.id[:], id) {
+		copy(pr.id[:], id)
+		pr.hash = NewPeerHash(addr, id)
+	}
+
+	return pr.hash
+}
+
 // localIP returns the first available local IP address.
 // This is the subnet address if the host is located in a subnet.
 func localIP() net.IP {
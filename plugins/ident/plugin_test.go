@@ -27,6 +27,27 @@ func TestConn(t *testing.T) {
 	<-time.After(time.Second / 2)
 }
 
+func TestPeerStateKey(t *testing.T) {
+	p := New(nil).(*Plugin)
+	p.Open(10023)
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10023}
+	state := p.NewPeer(addr)
+	packet := append(append([]byte(nil), p.id...), Payload...)
+
+	if want, have := p.PeerKey(addr, packet), p.PeerStateKey(state, addr, packet); have != want {
+		t.Fatalf("Key mismatch: Want %q, have %q", want, have)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		p.PeerStateKey(state, addr, packet)
+	})
+
+	if allocs != 0 {
+		t.Fatalf("Cached key allocates %v times", allocs)
+	}
+}
+
 func loop(t *testing.T, c *xudp.Connection) {
 	for {
 		addr, payload, err := c.Recv()
@@ -0,0 +1,44 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+/*
+The ordered plugin delivers the payloads of each peer in the order in
+which they were sent. It adds a 32-bit packet number to every packet.
+The numbers are counted separately for each peer and wrap around safely.
+
+Packets which arrive early, are kept in a bounded reorder buffer until
+the packets before them have arrived. Each arrival delivers every
+buffered packet which has become next in line. Packets which arrive after
+their turn has passed, and duplicates, are dropped.
+
+A missing packet is waited for until Config.HoleTimeout has passed.
+It is then skipped, along with any other missing packets in front of the
+buffered ones. Packets which are too far ahead to fit in the buffer,
+either skip the missing packets right away or are dropped, depending on
+Config.Overflow.
+
+A sender which restarts, or which forgets a peer before the peer forgets
+it, numbers its packets from scratch. A few packets in a row which are a
+whole window late, or which are dropped for being too far ahead, make the
+receiving end start over from the number of the latest one. Its buffered
+packets are delivered first. A peer which has not received anything yet,
+starts from the number of the first packet outside its window.
+
+Payloads are handed to the host through a DeliverFunc, rather than through
+the connection. The connection must still be read, to receive packets.
+Deliveries for a single peer never overlap, even when several goroutines
+read the connection.
+
+The plugin does not resend lost packets, and it does not compose with the
+retransmit plugin to provide reliable, ordered delivery. A resent message
+carries a new packet number. The hole it left is skipped after the
+timeout, and the message is delivered after the ones sent in the
+meantime. The order of delivery is only guaranteed for packets which are
+not lost.
+
+The plugin belongs to the delivery stage, so it sees each packet after the
+transport plugins, whatever the order of registration. It reads the
+control flag, so the ACKs and other control packets sent by those
+plugins are recognized and left unnumbered.
+*/
+package ordered
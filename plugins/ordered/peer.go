@@ -0,0 +1,231 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package ordered
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// resyncAfter is the number of packets in a row which must fall outside
+// the window, before a peer gives up on its numbering and follows theirs.
+const resyncAfter = 3
+
+// slot holds a buffered packet. Its buffer is reused by later packets.
+type slot struct {
+	payload []byte
+	ok      bool
+}
+
+// peer holds the numbering and reorder buffer for a single peer.
+//
+// Packet numbers wrap around. A packet is ahead of the next one in line,
+// if it is less than half the number space ahead of it. Otherwise it is
+// late.
+//
+// A packet which is late by a whole window or more, or which is too far
+// ahead to fit while the overflow behaviour is Drop, is a stray. The
+// sender has most likely restarted, or forgotten this end and numbers from
+// scratch. After a few strays in a row, the peer takes the number of the
+// latest one as the next in line. A peer which has not received anything
+// yet, does so right away.
+//
+// Payloads are delivered while mu is held. This keeps the deliveries for
+// a peer in order, even when packets are received by several goroutines.
+type peer struct {
+	addr     net.Addr
+	send     atomic.Uint32 // Number of the next outgoing packet.
+	overflow Overflow
+	mu       sync.Mutex    // Guards the fields below.
+	next     uint32        // Number of the next packet to deliver.
+	slots    []slot        // Ring buffer. The packet after next is at head+1, etc.
+	head     int           // Index of the slot for the next packet.
+	buffered int           // Number of packets in the buffer.
+	wait     time.Duration // Time the next packet has been missing.
+	strays   int           // Number of strays received in a row.
+	synced   bool          // Set once a packet has been accepted.
+}
+
+func newPeer(addr net.Addr, cfg Config) *peer {
+	return &peer{
+		addr:     addr,
+		overflow: cfg.Overflow,
+		slots:    make([]slot, cfg.Window),
+	}
+}
+
+// ahead returns the distance from the next packet in line to packet n, and
+// whether n is ahead of it at all.
+func (pr *peer) ahead(n uint32) (uint32, bool) {
+	d := n - pr.next
+	return d, d < 1<<31
+}
+
+// recv delivers or buffers the packet with number n.
+func (pr *peer) recv(p *Plugin, n uint32, payload []byte) {
+	d, ok := pr.ahead(n)
+
+	if pr.stray(n) {
+		pr.strays++
+
+		if pr.synced && pr.strays < resyncAfter {
+			p.dropped.Add(1)
+			return
+		}
+
+		pr.resync(p, n)
+		d, ok = 0, true
+	}
+
+	pr.strays = 0
+
+	if !ok {
+		p.dropped.Add(1) // Late or duplicate.
+		return
+	}
+
+	pr.synced = true
+
+	if d >= uint32(len(pr.slots)) {
+		if pr.overflow == Drop {
+			p.dropped.Add(1)
+			return
+		}
+
+		pr.advance(p, n-uint32(len(pr.slots))+1)
+		d, _ = pr.ahead(n)
+	}
+
+	if d == 0 {
+		p.emit(pr.addr, payload)
+		pr.step()
+		pr.wait = 0
+		pr.drain(p)
+		return
+	}
+
+	s := pr.slot(d)
+
+	if s.ok {
+		p.dropped.Add(1) // Duplicate.
+		return
+	}
+
+	s.payload = append(s.payload[:0], payload...)
+	s.ok = true
+	pr.buffered++
+}
+
+// stray returns true if packet n falls outside the window, and is not
+// simply skipped to. See peer.
+func (pr *peer) stray(n uint32) bool {
+	window := uint32(len(pr.slots))
+
+	if d, ok := pr.ahead(n); ok {
+		return d >= window && (pr.overflow == Drop || !pr.synced)
+	}
+
+	return pr.next-n >= window
+}
+
+// resync delivers the buffered packets and makes n the next packet in line.
+// Missing packets in the old numbering are not counted as skipped.
+func (pr *peer) resync(p *Plugin, n uint32) {
+	for pr.buffered > 0 {
+		s := pr.slot(0)
+
+		if s.ok {
+			p.emit(pr.addr, s.payload)
+			s.ok = false
+			pr.buffered--
+		}
+
+		pr.step()
+	}
+
+	pr.next = n
+	pr.wait = 0
+}
+
+// advance moves the next packet in line up to n. Buffered packets on the
+// way are delivered. Missing ones are skipped.
+func (pr *peer) advance(p *Plugin, n uint32) {
+	for pr.next != n {
+		if pr.buffered == 0 {
+			// All slots are empty, so the head can stay where it is.
+			p.skipped.Add(uint64(n - pr.next))
+			pr.next = n
+			break
+		}
+
+		s := pr.slot(0)
+
+		if s.ok {
+			p.emit(pr.addr, s.payload)
+			s.ok = false
+			pr.buffered--
+		} else {
+			p.skipped.Add(1)
+		}
+
+		pr.step()
+	}
+
+	pr.wait = 0
+	pr.drain(p)
+}
+
+// drain delivers the buffered packets which directly follow the last
+// delivered one.
+func (pr *peer) drain(p *Plugin) {
+	for pr.buffered > 0 {
+		s := pr.slot(0)
+
+		if !s.ok {
+			return
+		}
+
+		p.emit(pr.addr, s.payload)
+		s.ok = false
+		pr.buffered--
+		pr.step()
+	}
+}
+
+// expire skips the missing packets in front of the buffered ones, once
+// they have been waited for longer than the timeout.
+func (pr *peer) expire(p *Plugin, delta, timeout time.Duration) {
+	if pr.buffered == 0 {
+		pr.wait = 0
+		return
+	}
+
+	pr.wait += delta
+
+	if pr.wait < timeout {
+		return
+	}
+
+	var d uint32
+
+	for !pr.slot(d).ok {
+		d++
+	}
+
+	pr.advance(p, pr.next+d)
+}
+
+// slot returns the slot for the packet which is d places after the next
+// one in line. The distance must be less than the window.
+func (pr *peer) slot(d uint32) *slot {
+	return &pr.slots[(pr.head+int(d))%len(pr.slots)]
+}
+
+// step moves the next packet in line and the head of the ring forward.
+func (pr *peer) step() {
+	pr.next++
+	pr.head = (pr.head + 1) % len(pr.slots)
+}
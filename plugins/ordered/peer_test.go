@@ -0,0 +1,207 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package ordered
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReorder(t *testing.T) {
+	tests := [][]uint32{
+		{0, 1, 2, 3, 4, 5},
+		{5, 4, 3, 2, 1, 0},
+		{1, 0, 3, 2, 5, 4},
+		{2, 4, 0, 5, 1, 3},
+		{0, 2, 2, 1, 0, 3, 4, 5},
+	}
+
+	for i, order := range tests {
+		p, pr, got := newTestPeer(Config{Window: 8}, 0)
+
+		for _, n := range order {
+			pr.recv(p, n, payload(n))
+		}
+
+		if want := "0 1 2 3 4 5"; got() != want {
+			t.Fatalf("Order %d: Want %q, got %q", i, want, got())
+		}
+
+		if pr.buffered != 0 || pr.next != 6 {
+			t.Fatalf("Order %d: %d packets left in the buffer", i, pr.buffered)
+		}
+
+		if st := p.Stats(); st.Dropped != uint64(len(order)-6) || st.Skipped != 0 {
+			t.Fatalf("Order %d: Unexpected stats %+v", i, st)
+		}
+	}
+}
+
+func TestReorderWrapped(t *testing.T) {
+	const max = 1<<32 - 1
+
+	p, pr, got := newTestPeer(Config{Window: 8}, max-2)
+
+	for _, n := range []uint32{max, 1, max - 1, 0, max - 2, 2, max - 5} {
+		pr.recv(p, n, payload(n))
+	}
+
+	want := fmt.Sprintf("%d %d %d 0 1 2", uint32(max-2), uint32(max-1), uint32(max))
+
+	if got() != want {
+		t.Fatalf("Want %q, got %q", want, got())
+	}
+
+	// The last packet was late.
+	if st := p.Stats(); st.Dropped != 1 || pr.next != 3 {
+		t.Fatalf("Unexpected state: next %d, stats %+v", pr.next, p.Stats())
+	}
+}
+
+func TestReorderWrappedWindow(t *testing.T) {
+	const max = 1<<32 - 1
+
+	// With a window which does not divide the number space, packets max
+	// and 0 must still end up in different slots.
+	p, pr, got := newTestPeer(Config{Window: 5}, max-1)
+
+	for _, n := range []uint32{max, 0, 2, 1, max - 1} {
+		pr.recv(p, n, payload(n))
+	}
+
+	want := fmt.Sprintf("%d %d 0 1 2", uint32(max-1), uint32(max))
+
+	if got() != want || pr.buffered != 0 || p.Stats().Dropped != 0 {
+		t.Fatalf("Want %q, got %q; stats %+v", want, got(), p.Stats())
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	p, pr, got := newTestPeer(Config{Window: 4}, 0)
+
+	for _, n := range []uint32{1, 2, 5} {
+		pr.recv(p, n, payload(n))
+	}
+
+	// Packet 0 is skipped, so 5 fits. Packets 1 and 2 are delivered on
+	// the way.
+	if want := "1 2"; got() != want || pr.next != 3 || p.Stats().Skipped != 1 {
+		t.Fatalf("Want %q, got %q; next %d, stats %+v", want, got(), pr.next, p.Stats())
+	}
+
+	// A jump far ahead skips everything in between.
+	pr.recv(p, 1000, payload(1000))
+
+	if want := "1 2 5"; got() != want || pr.next != 997 || pr.buffered != 1 {
+		t.Fatalf("Want %q, got %q; next %d", want, got(), pr.next)
+	}
+
+	p, pr, got = newTestPeer(Config{Window: 4, Overflow: Drop}, 0)
+
+	for _, n := range []uint32{1, 5, 0} {
+		pr.recv(p, n, payload(n))
+	}
+
+	if want := "0 1"; got() != want || p.Stats().Dropped != 1 {
+		t.Fatalf("Want %q, got %q; stats %+v", want, got(), p.Stats())
+	}
+}
+
+func TestResync(t *testing.T) {
+	// A fresh peer follows the first packet, however far ahead it is.
+	for _, overflow := range []Overflow{Skip, Drop} {
+		p, pr, got := newTestPeer(Config{Window: 4, Overflow: overflow}, 0)
+		pr.recv(p, 1000, payload(1000))
+
+		if want := "1000"; got() != want || pr.next != 1001 || p.Stats().Skipped != 0 {
+			t.Fatalf("Overflow %d: Want %q, got %q; next %d", overflow, want, got(), pr.next)
+		}
+	}
+
+	// The sender restarts. The buffered packet is delivered first.
+	p, pr, got := newTestPeer(Config{Window: 4}, 0)
+
+	// Packets 0 to 3 are numbered from scratch, so they are late.
+	for _, n := range []uint32{500, 502, 0, 1, 2, 3} {
+		pr.recv(p, n, payload(n))
+	}
+
+	if want := "500 502 2 3"; got() != want || pr.buffered != 0 || pr.next != 4 {
+		t.Fatalf("Want %q, got %q; next %d", want, got(), pr.next)
+	}
+
+	// The receiver forgot the sender, which kept counting. Strays which
+	// are interrupted by packets in the window, do not resync.
+	p, pr, got = newTestPeer(Config{Window: 4, Overflow: Drop}, 0)
+
+	for _, n := range []uint32{0, 10, 11, 1, 12, 13} {
+		pr.recv(p, n, payload(n))
+	}
+
+	if want := "0 1"; got() != want || p.Stats().Dropped != 4 {
+		t.Fatalf("Want %q, got %q; stats %+v", want, got(), p.Stats())
+	}
+
+	pr.recv(p, 14, payload(14))
+	pr.recv(p, 15, payload(15))
+
+	if want := "0 1 14 15"; got() != want || pr.next != 16 {
+		t.Fatalf("Want %q, got %q; next %d", want, got(), pr.next)
+	}
+}
+
+func TestHoleTimeout(t *testing.T) {
+	p, pr, got := newTestPeer(Config{Window: 8}, 0)
+
+	pr.recv(p, 0, payload(0))
+	pr.recv(p, 2, payload(2))
+	pr.recv(p, 3, payload(3))
+	pr.recv(p, 5, payload(5))
+
+	pr.expire(p, time.Millisecond*100, time.Millisecond*250)
+	pr.expire(p, time.Millisecond*100, time.Millisecond*250)
+
+	if want := "0"; got() != want {
+		t.Fatalf("Hole was skipped too early: %q", got())
+	}
+
+	// Skipping 1 releases 2 and 3. Packet 5 waits from scratch.
+	pr.expire(p, time.Millisecond*100, time.Millisecond*250)
+
+	if want := "0 2 3"; got() != want || pr.wait != 0 {
+		t.Fatalf("Want %q, got %q", want, got())
+	}
+
+	pr.expire(p, time.Millisecond*200, time.Millisecond*250)
+	pr.expire(p, time.Millisecond*100, time.Millisecond*250)
+
+	if want := "0 2 3 5"; got() != want || p.Stats().Skipped != 2 {
+		t.Fatalf("Want %q, got %q; stats %+v", want, got(), p.Stats())
+	}
+}
+
+// newTestPeer creates a plugin and a peer whose next packet is the given
+// one. The returned function lists the delivered payloads.
+func newTestPeer(cfg Config, next uint32) (*Plugin, *peer, func() string) {
+	var list string
+
+	p := New(func(addr net.Addr, payload []byte) {
+		if len(list) > 0 {
+			list += " "
+		}
+
+		list += string(payload)
+	}).(*Plugin)
+
+	p.SetConfig(cfg)
+	pr := p.NewPeer(&net.UDPAddr{}).(*peer)
+	pr.next = next
+	return p, pr, func() string { return list }
+}
+
+func payload(n uint32) []byte {
+	return []byte(fmt.Sprint(n))
+}
@@ -0,0 +1,270 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package ordered
+
+import (
+	"errors"
+	"github.com/jteeuwen/xudp"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for the fields of Config.
+const (
+	DefaultWindow      = 64
+	DefaultHoleTimeout = 250 * time.Millisecond
+)
+
+var ErrConfig = errors.New("Window must not be negative and Overflow must be known.")
+
+var (
+	_ xudp.PeerPlugin    = (*Plugin)(nil)
+	_ xudp.ControlReader = (*Plugin)(nil)
+	_ xudp.Stager        = (*Plugin)(nil)
+	_ xudp.Ticker        = (*Plugin)(nil)
+)
+
+// DeliverFunc receives the payloads of a peer in order. The payload is
+// only valid until the call returns.
+type DeliverFunc func(addr net.Addr, payload []byte)
+
+// Overflow determines what happens to a packet which is too far ahead to
+// fit in the reorder buffer.
+type Overflow int
+
+// Known overflow behaviours.
+const (
+	// Skip the oldest missing packets, until the new packet fits.
+	Skip Overflow = iota
+
+	// Drop the new packet and keep waiting for the missing ones. After a
+	// few such packets in a row, the sender is assumed to have restarted
+	// its numbering, and the peer follows it.
+	Drop
+)
+
+// Config holds the settings for the reorder buffer of each peer. Fields
+// which are left zero, select their default value.
+type Config struct {
+	Window      int           // Number of packets which can be buffered for each peer.
+	HoleTimeout time.Duration // Time to wait for a missing packet before skipping it. Negative waits forever.
+	Overflow    Overflow      // What to do with packets which do not fit in the buffer.
+}
+
+// normalize fills in the defaults and validates the result.
+func (c Config) normalize() (Config, error) {
+	if c.Window == 0 {
+		c.Window = DefaultWindow
+	}
+
+	if c.HoleTimeout == 0 {
+		c.HoleTimeout = DefaultHoleTimeout
+	}
+
+	if c.Window < 0 || c.Overflow < Skip || c.Overflow > Drop {
+		return c, ErrConfig
+	}
+
+	return c, nil
+}
+
+// Stats holds the counters of a Plugin at a single point in time.
+type Stats struct {
+	Delivered uint64 // Number of payloads handed to the host.
+	Skipped   uint64 // Number of missing packets which were given up on.
+	Dropped   uint64 // Number of late, duplicate or overflowing packets.
+}
+
+// Plugin numbers outgoing packets and delivers incoming ones in order.
+type Plugin struct {
+	deliver   DeliverFunc
+	delivered atomic.Uint64
+	skipped   atomic.Uint64
+	dropped   atomic.Uint64
+	mu        sync.Mutex // Guards the fields below.
+	peers     map[*peer]struct{}
+	config    Config
+	ticked    time.Time // Time of the previous tick.
+}
+
+// New creates a new ordered plugin, which hands the payloads it receives
+// to deliver, in the order in which they were sent.
+//
+// The plugin consumes all payloads. The connection's Recv, Serve and
+// Incoming methods no longer yield them, but one of them must still be
+// called to receive packets.
+func New(deliver DeliverFunc) xudp.Plugin {
+	p := new(Plugin)
+	p.deliver = deliver
+	p.config, _ = Config{}.normalize()
+	p.peers = make(map[*peer]struct{})
+	return p
+}
+
+// PayloadSize returns the size of the packet number.
+func (p *Plugin) PayloadSize() int { return 4 }
+
+// Stage returns StageDelivery, so all transport plugins have processed
+// a packet before it is delivered.
+func (p *Plugin) Stage() xudp.Stage { return xudp.StageDelivery }
+
+// Open and Close forget all peers. Numbering starts from scratch when
+// the connection is opened.
+func (p *Plugin) Open(port int) error {
+	p.reset()
+	return nil
+}
+
+func (p *Plugin) Close() error {
+	p.reset()
+	return nil
+}
+
+func (p *Plugin) reset() {
+	p.mu.Lock()
+	clear(p.peers)
+	p.ticked = time.Time{}
+	p.mu.Unlock()
+}
+
+// SetConfig changes the reorder buffer settings. Returns ErrConfig if they
+// are not valid. The window and overflow behaviour apply to peers which
+// are created after the call. The hole timeout applies to all peers.
+func (p *Plugin) SetConfig(cfg Config) error {
+	cfg, err := cfg.normalize()
+
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.config = cfg
+	p.mu.Unlock()
+	return nil
+}
+
+// Stats returns a snapshot of the plugin's counters.
+func (p *Plugin) Stats() Stats {
+	return Stats{
+		Delivered: p.delivered.Load(),
+		Skipped:   p.skipped.Load(),
+		Dropped:   p.dropped.Load(),
+	}
+}
+
+// ReadsControl returns true. Each packet carries a control flag, so the
+// packets injected by other plugins can be recognized and left unnumbered.
+func (p *Plugin) ReadsControl() bool { return true }
+
+// NewPeer creates the numbering and reorder buffer for a new peer.
+func (p *Plugin) NewPeer(addr net.Addr) interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pr := newPeer(addr, p.config)
+	p.peers[pr] = struct{}{}
+	return pr
+}
+
+// ClosePeer forgets a peer. Packets in its buffer are not delivered.
+func (p *Plugin) ClosePeer(addr net.Addr, state interface{}) {
+	p.mu.Lock()
+	delete(p.peers, state.(*peer))
+	p.mu.Unlock()
+}
+
+// Send and Recv are not called. Packets are handled by SendPeer and
+// RecvPeer instead.
+func (p *Plugin) Send(net.Addr, []byte, int) error { return nil }
+func (p *Plugin) Recv(net.Addr, []byte, int) error { return nil }
+
+// SendPeer writes the number of an outgoing packet. Control packets are
+// not numbered.
+func (p *Plugin) SendPeer(state interface{}, addr net.Addr, b []byte, index int) (int, error) {
+	var n uint32
+
+	if !xudp.IsControl(b, index) {
+		n = state.(*peer).send.Add(1) - 1
+	}
+
+	b[0] = byte(n >> 24)
+	b[1] = byte(n >> 16)
+	b[2] = byte(n >> 8)
+	b[3] = byte(n)
+	return 4, nil
+}
+
+// RecvPeer delivers the packet if it is the next one in line, along with
+// any buffered packets which follow it. Packets which arrive early, are
+// buffered. The packet is then discarded, since it has been delivered.
+func (p *Plugin) RecvPeer(state interface{}, addr net.Addr, b []byte, index int) error {
+	if xudp.IsControl(b, index) {
+		return nil
+	}
+
+	pr := state.(*peer)
+	n := uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+
+	pr.mu.Lock()
+	pr.recv(p, n, b[index:])
+	pr.mu.Unlock()
+	return xudp.ErrDiscard
+}
+
+// TickInterval returns the resolution of the hole timeout. Plugins which
+// wait forever are not ticked.
+func (p *Plugin) TickInterval() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config.HoleTimeout < 0 {
+		return 0
+	}
+
+	return max(p.config.HoleTimeout/4, time.Millisecond)
+}
+
+// Tick skips the holes which have been waited for long enough.
+func (p *Plugin) Tick(now time.Time) {
+	interval := p.TickInterval()
+
+	p.mu.Lock()
+
+	delta := interval
+
+	if !p.ticked.IsZero() {
+		delta = now.Sub(p.ticked)
+	}
+
+	p.ticked = now
+	timeout := p.config.HoleTimeout
+	peers := make([]*peer, 0, len(p.peers))
+
+	for pr := range p.peers {
+		peers = append(peers, pr)
+	}
+
+	p.mu.Unlock()
+
+	if timeout < 0 {
+		return
+	}
+
+	for _, pr := range peers {
+		pr.mu.Lock()
+		pr.expire(p, delta, timeout)
+		pr.mu.Unlock()
+	}
+}
+
+// emit hands a payload to the host.
+func (p *Plugin) emit(addr net.Addr, payload []byte) {
+	p.delivered.Add(1)
+
+	if p.deliver != nil {
+		p.deliver(addr, payload)
+	}
+}
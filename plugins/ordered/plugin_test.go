@@ -0,0 +1,140 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package ordered
+
+import (
+	"fmt"
+	"github.com/jteeuwen/xudp"
+	"github.com/jteeuwen/xudp/plugins/reliability"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConn(t *testing.T) {
+	recv := make(chan string, 20)
+
+	ca := initConn(t, 10041, nil)
+	cb := initConn(t, 10042, func(addr net.Addr, payload []byte) {
+		recv <- string(payload)
+	})
+
+	defer ca.Close()
+	defer cb.Close()
+
+	go pump(ca)
+	go pump(cb)
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10042}
+
+	for i := 0; i < 20; i++ {
+		if err := ca.Send(addr, payload(uint32(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	timeout := time.After(time.Second)
+
+	for i := 0; i < 20; i++ {
+		select {
+		case got := <-recv:
+			if got != fmt.Sprint(i) {
+				t.Fatalf("Want payload %d, got %s", i, got)
+			}
+		case <-timeout:
+			t.Fatalf("Only %d of 20 payloads were delivered", i)
+		}
+	}
+}
+
+func TestConnReordered(t *testing.T) {
+	recv := make(chan string, 10)
+
+	c := xudp.New(1400)
+	c.Register(New(func(addr net.Addr, payload []byte) {
+		recv <- string(payload)
+	}))
+
+	err := c.Open(10043)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+	go pump(c)
+
+	uc, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10043})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer uc.Close()
+
+	// Packet number, data flag and payload, sent out of order.
+	for _, n := range []uint32{3, 1, 4, 0, 2, 6, 5} {
+		packet := []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n), 0}
+		uc.Write(append(packet, payload(n)...))
+	}
+
+	var got []string
+	timeout := time.After(time.Second)
+
+	for len(got) < 7 {
+		select {
+		case s := <-recv:
+			got = append(got, s)
+		case <-timeout:
+			t.Fatalf("Only %d of 7 payloads were delivered: %v", len(got), got)
+		}
+	}
+
+	if want := "0 1 2 3 4 5 6"; strings.Join(got, " ") != want {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	p := New(nil).(*Plugin)
+
+	for i, cfg := range []Config{{Window: -1}, {Overflow: Drop + 1}} {
+		if p.SetConfig(cfg) != ErrConfig {
+			t.Fatalf("Config %d was accepted", i)
+		}
+	}
+
+	p.SetConfig(Config{HoleTimeout: -1})
+
+	if p.TickInterval() != 0 {
+		t.Fatalf("Plugin without a hole timeout is ticked")
+	}
+}
+
+// initConn opens a connection with the reliability and ordered plugins.
+// The standalone ACKs of the reliability plugin are not numbered. The
+// ordered plugin is registered first, but its stage puts it innermost.
+func initConn(t *testing.T, port int, deliver DeliverFunc) *xudp.Connection {
+	c := xudp.New(1400)
+	c.Register(New(deliver))
+	c.Register(reliability.New(nil, nil, nil, nil, 60))
+
+	err := c.Open(port)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// pump receives packets until the connection closes.
+func pump(c *xudp.Connection) {
+	for {
+		if _, _, err := c.Recv(); err != nil {
+			return
+		}
+	}
+}
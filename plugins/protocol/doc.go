@@ -14,9 +14,12 @@ This protocol id can be any number you want, but it is advised to use
 something relatively unique. A 4 byte hash of the name of your program
 can be a suitable id.
 
-For best results, we recommend that this is the first plugin you register.
-This ensures it is executed first for every packet. If a packet does not
-match the given protocol ID, we do not have to waste time and resources
-on other plugins being run.
+The plugin belongs to the filter stage. This ensures it is executed first
+for every received packet, regardless of the order in which plugins are
+registered. If a packet does not match the given protocol ID, we do not
+have to waste time and resources on other plugins being run.
+
+The plugin keeps no state of its own. A single instance therefore serves
+any number of peers, without needing per-peer state.
 */
 package protocol
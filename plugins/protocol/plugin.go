@@ -20,6 +20,7 @@ func New(protocolId uint32) xudp.Plugin {
 }
 
 func (p *Plugin) PayloadSize() int    { return 4 }
+func (p *Plugin) Stage() xudp.Stage   { return xudp.StageFilter }
 func (c *Plugin) Open(port int) error { return nil }
 func (c *Plugin) Close() error        { return nil }
 
@@ -0,0 +1,229 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package reliability
+
+import "errors"
+
+// An AckMode selects how a peer acknowledges the packets it received before
+// the one named in the ACK field. The mode is stored in every header, so
+// the receiving end always knows how to read it.
+type AckMode uint8
+
+// Known ACK modes.
+const (
+	Ack32     AckMode = iota // 32-bit vector. This is the default.
+	Ack64                    // 64-bit vector.
+	Ack128                   // 128-bit vector.
+	AckRanges                // Up to MaxAckRanges ranges of received packets.
+	ackModes
+)
+
+// MaxAckRanges is the number of ranges an AckRanges field can hold. Each
+// range is a run of received packets, preceded by a gap of missing ones.
+const MaxAckRanges = 4
+
+// Number of packets before the ACK which AckRanges can acknowledge.
+const rangeWindow = 1024
+
+var ErrAckMode = errors.New("Unknown ACK mode.")
+
+// window returns the number of packets before the ACK which the mode can
+// acknowledge.
+func (m AckMode) window() uint32 {
+	switch m {
+	case Ack64:
+		return 64
+	case Ack128:
+		return 128
+	case AckRanges:
+		return rangeWindow
+	}
+
+	return 32
+}
+
+// size returns the largest size in bytes of an ACK field in this mode.
+func (m AckMode) size() int {
+	switch m {
+	case Ack64:
+		return 8
+	case Ack128:
+		return 16
+	case AckRanges:
+		return 1 + 4*MaxAckRanges
+	}
+
+	return 4
+}
+
+// ackRange describes a run of received packets, which follows a gap of
+// packets which were not received.
+type ackRange struct {
+	gap, run uint16
+}
+
+// ackField acknowledges the packets received before the one named in the
+// ACK field. Bit i refers to sequence number ACK-1-i.
+type ackField struct {
+	mode   AckMode
+	bits   [2]uint64 // Vector for the bitfield modes.
+	ranges [MaxAckRanges]ackRange
+	n      int // Number of ranges in use.
+}
+
+// set marks the given bit as received. For AckRanges, bits must be set in
+// increasing order. Returns false if the field has no room for it.
+func (f *ackField) set(bit uint32) bool {
+	if bit >= f.mode.window() {
+		return false
+	}
+
+	if f.mode != AckRanges {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	}
+
+	var next uint32 // First bit past the last range.
+
+	for _, r := range f.ranges[:f.n] {
+		next += uint32(r.gap) + uint32(r.run)
+	}
+
+	if f.n > 0 && bit == next {
+		f.ranges[f.n-1].run++
+		return true
+	}
+
+	if f.n == MaxAckRanges || bit < next {
+		return false
+	}
+
+	f.ranges[f.n] = ackRange{gap: uint16(bit - next), run: 1}
+	f.n++
+	return true
+}
+
+// has returns true if the given bit is marked as received.
+func (f *ackField) has(bit uint32) bool {
+	if bit >= f.mode.window() {
+		return false
+	}
+
+	if f.mode != AckRanges {
+		return (f.bits[bit/64]>>(bit%64))&1 != 0
+	}
+
+	var pos uint32
+
+	for _, r := range f.ranges[:f.n] {
+		pos += uint32(r.gap)
+
+		if bit < pos {
+			return false
+		}
+
+		if bit < pos+uint32(r.run) {
+			return true
+		}
+
+		pos += uint32(r.run)
+	}
+
+	return false
+}
+
+// encode writes the field to b and returns its size.
+func (f *ackField) encode(b []byte) int {
+	switch f.mode {
+	case Ack64:
+		putUint64(b, f.bits[0])
+	case Ack128:
+		putUint64(b, f.bits[1])
+		putUint64(b[8:], f.bits[0])
+	case AckRanges:
+		b[0] = byte(f.n)
+
+		for i, r := range f.ranges[:f.n] {
+			b[1+i*4] = byte(r.gap >> 8)
+			b[2+i*4] = byte(r.gap)
+			b[3+i*4] = byte(r.run >> 8)
+			b[4+i*4] = byte(r.run)
+		}
+
+		return 1 + 4*f.n
+	default:
+		putUint32(b, uint32(f.bits[0]))
+	}
+
+	return f.mode.size()
+}
+
+// decode reads a field in the given mode from b.
+func (f *ackField) decode(mode AckMode, b []byte) {
+	f.mode = mode
+
+	switch mode {
+	case Ack64:
+		f.bits[0] = getUint64(b)
+	case Ack128:
+		f.bits[1] = getUint64(b)
+		f.bits[0] = getUint64(b[8:])
+	case AckRanges:
+		f.n = int(b[0])
+
+		for i := range f.ranges[:f.n] {
+			f.ranges[i].gap = uint16(b[1+i*4])<<8 | uint16(b[2+i*4])
+			f.ranges[i].run = uint16(b[3+i*4])<<8 | uint16(b[4+i*4])
+		}
+	default:
+		f.bits[0] = uint64(getUint32(b))
+	}
+}
+
+// fieldSize returns the size of the ACK field in the given mode, which
+// starts at b[0]. Returns false if the mode is unknown or b is too short.
+func fieldSize(mode AckMode, b []byte) (int, bool) {
+	size := mode.size()
+
+	switch {
+	case mode >= ackModes:
+		return 0, false
+	case mode != AckRanges:
+	case len(b) == 0 || b[0] > MaxAckRanges:
+		return 0, false
+	default:
+		size = 1 + 4*int(b[0])
+	}
+
+	return size, len(b) >= size
+}
+
+func putUint16(b []byte, n uint16) {
+	b[0] = byte(n >> 8)
+	b[1] = byte(n)
+}
+
+func getUint16(b []byte) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func putUint32(b []byte, n uint32) {
+	b[0] = byte(n >> 24)
+	b[1] = byte(n >> 16)
+	b[2] = byte(n >> 8)
+	b[3] = byte(n)
+}
+
+func getUint32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func putUint64(b []byte, n uint64) {
+	putUint32(b, uint32(n>>32))
+	putUint32(b[4:], uint32(n))
+}
+
+func getUint64(b []byte) uint64 {
+	return uint64(getUint32(b))<<32 | uint64(getUint32(b[4:]))
+}
@@ -0,0 +1,155 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package reliability
+
+import (
+	"github.com/jteeuwen/xudp"
+	"testing"
+)
+
+func TestAckField(t *testing.T) {
+	bits := []uint32{0, 1, 2, 5, 31, 32, 63, 64, 100, 127, 128, 500, 1023, 1024}
+
+	for mode := Ack32; mode < ackModes; mode++ {
+		var f, g ackField
+		var buf [32]byte
+
+		f.mode = mode
+
+		for _, bit := range bits {
+			want := bit < mode.window() && (mode != AckRanges || f.n < MaxAckRanges ||
+				bit == lastBit(&f)+1)
+
+			if f.set(bit) != want {
+				t.Fatalf("Mode %d: set(%d) should return %v", mode, bit, want)
+			}
+		}
+
+		n := f.encode(buf[:])
+		size, ok := fieldSize(mode, buf[:n])
+
+		if !ok || size != n || n > mode.size() {
+			t.Fatalf("Mode %d: Size mismatch: encoded %d, read %d", mode, n, size)
+		}
+
+		g.decode(mode, buf[:n])
+
+		for bit := uint32(0); bit <= rangeWindow; bit++ {
+			if f.has(bit) != g.has(bit) {
+				t.Fatalf("Mode %d: Bit %d changed in transit", mode, bit)
+			}
+		}
+	}
+}
+
+func TestAckRanges(t *testing.T) {
+	f := ackField{mode: AckRanges}
+
+	for _, bit := range []uint32{0, 1, 2, 10, 11, 40, 900, 901} {
+		if !f.set(bit) {
+			t.Fatalf("Bit %d was not set", bit)
+		}
+	}
+
+	if f.set(950) {
+		t.Fatalf("Fifth range was accepted")
+	}
+
+	want := [MaxAckRanges]ackRange{{0, 3}, {7, 2}, {28, 1}, {859, 2}}
+
+	if f.n != MaxAckRanges || f.ranges != want {
+		t.Fatalf("Range mismatch: %v", f.ranges[:f.n])
+	}
+
+	for bit, ok := range map[uint32]bool{2: true, 3: false, 11: true, 39: false, 901: true, 902: false} {
+		if f.has(bit) != ok {
+			t.Fatalf("Bit %d: Want %v", bit, ok)
+		}
+	}
+}
+
+func TestAckVectorModes(t *testing.T) {
+	r := NewReliability()
+
+	for i := 0; i < 200; i++ {
+		if i != 150 {
+			r.recvQueue.Insert(packetData{sequence: uint32(i)})
+		}
+	}
+
+	r.stats.RemoteSequence = 199
+
+	for mode := Ack32; mode < ackModes; mode++ {
+		r.mode = mode
+		f := r.ackVector()
+
+		for bit := uint32(0); bit < 200; bit++ {
+			want := bit < 199 && bit != 48 && bit < mode.window()
+
+			if f.has(bit) != want {
+				t.Fatalf("Mode %d: Bit %d should be %v", mode, bit, want)
+			}
+		}
+	}
+}
+
+func TestProcessAckWide(t *testing.T) {
+	r := NewReliability()
+
+	for i := 0; i < 129; i++ {
+		r.pendingAckQueue.Insert(packetData{sequence: uint32(i)})
+	}
+
+	f := ackField{mode: Ack128, bits: [2]uint64{^uint64(0), ^uint64(0)}}
+	acked := r.processAck(128, &f, nil)
+
+	if len(acked) != 129 || len(r.pendingAckQueue) != 0 {
+		t.Fatalf("Want 129 ACK'ed packets, have %d", len(acked))
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	p := New(nil, nil, nil, nil, 30).(*Plugin)
+	p.SetConfig(Config{AckMode: Ack64})
+
+	tests := []struct {
+		header []byte
+		size   int
+	}{
+		{[]byte{byte(Ack32), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 13},
+		{[]byte{byte(Ack64), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 17},
+		{[]byte{byte(Ack64), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, -1},
+		{[]byte{byte(Ack128), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 25},
+		{[]byte{byte(AckRanges), 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1}, 14},
+		{[]byte{byte(AckRanges), 0, 0, 0, 0, 0, 0, 0, 0, 5, 0, 0, 0, 1}, -1},
+		{[]byte{byte(Ack32), 0, 0, 0}, -1},
+	}
+
+	for i, ht := range tests {
+		size, err := p.HeaderSize(ht.header)
+
+		if ht.size < 0 {
+			if err != xudp.ErrDiscard {
+				t.Fatalf("Header %d: Want ErrDiscard, got %d, %v", i, size, err)
+			}
+		} else if err != nil || size != ht.size {
+			t.Fatalf("Header %d: Want size %d, got %d, %v", i, ht.size, size, err)
+		}
+	}
+
+	if p.SetConfig(Config{AckMode: ackModes}) != ErrAckMode {
+		t.Fatalf("Invalid ACK mode was accepted")
+	}
+}
+
+// lastBit returns the last bit covered by the ranges in f.
+func lastBit(f *ackField) uint32 {
+	var bit uint32
+
+	for _, r := range f.ranges[:f.n] {
+		bit += uint32(r.gap) + uint32(r.run)
+	}
+
+	return bit - 1
+}
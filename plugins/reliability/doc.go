@@ -11,15 +11,17 @@ which have been either ACK'ed or lost. The host application can then
 chose to take whatever action is necessary. For any lost packets, it may
 chose to resend the lost payload if necessary.
 
-It achieves all this by adding three 32-bit integer fields to the packet
-header. The first one is a numerical Sequence value, which identifies the
-specific packet.
+It achieves all this by adding a small header to each packet. It starts
+with a flags byte, which describes the format of the rest of the header.
+It is followed by two 32-bit integer fields. The first one is a numerical
+Sequence value, which identifies the specific packet.
 
 The second field is the ACK field. It holds the sequence number of a
 packet we have previously received and are acknowledging to the other peer.
 
-The third field is an ACK vector. Combined with the ACK field, this allows
-us to piggyback up to 33 ACKS simultaneously in a single data packet.
+The header ends with an ACK vector. By default, it is 32 bits wide.
+Combined with the ACK field, this allows us to piggyback up to 33 ACKS
+simultaneously in a single data packet.
 Even when a number of packets are lost, this creates a highly redundant
 packet acknowledgement mechanism.
 
@@ -35,6 +37,48 @@ To illustrate:
 	  This allows the other end to see at a glance which of the last 33
 	  packets should be marked as lost or not.
 
+Links with many packets in flight can use a wider vector. Config.AckMode
+selects a 64-bit or 128-bit vector, or a list of up to four ranges of
+received packets (selective ACKs). The ranges cover the 1024 packets before
+the ACK field, at the cost of detail once more than four runs of packets
+are missing. The mode is stored in the flags byte, so the other end reads
+each header in the format it was written in. Both ends may use different
+modes, and change them at any time. The plugin reserves room for the
+largest header in every packet, so changing modes does not change the
+connection's PayloadSize.
+
+Config.Compact halves the size of the sequence and ACK fields. The 16-bit
+values wrap around much sooner, so the receiving end widens each one to
+the 32-bit sequence number nearest to the last one it saw. The handlers
+see the same 32-bit numbers on both ends, as long as no more than 32767
+packets go missing in a row. A compact header with a 32-bit vector takes
+9 bytes, rather than 13. The setting is stored in the flags byte as well.
+Each packet is read with the field offsets it was written with, so the
+ends need not switch at the same time.
+
+ACKs normally travel in the headers of packets sent by the host. When the
+host has nothing to send to a peer, the plugin sends the ACKs in a control
+packet of its own. This happens once the oldest unacknowledged packet has
+waited for Config.AckDelay (20ms by default), or right away once
+Config.AckEvery packets are waiting. A one-way stream is therefore
+acknowledged without any help from the host. The receiving connection
+consumes control packets itself. They are not sequenced and are never
+ACK'ed themselves.
+
+A packet is considered lost when it has not been ACK'ed within the
+retransmission timeout (RTO). The RTO is derived from the measured round
+trip time, as described by RFC 6298, so losses on fast links are reported
+quickly. Each loss doubles the RTO, until a packet sent after the loss is
+ACK'ed (Karn's rule). Its bounds can be changed through Plugin.SetConfig.
+
+Sequence numbers, queues and statistics are kept separately for each peer
+the connection talks to. The state for each peer is available through
+Plugin.Peers. Reliability.Stats returns a consistent snapshot of a peer's
+round trip time, bandwidth and packet loss, and may be called from any
+goroutine. The connection updates the queues while it is open. All
+peers are forgotten when it closes, so a reopened connection starts with
+fresh sequence numbers and statistics.
+
 This plugin does not resend lost packets itself.
 We simply offer a way for the host application to know about lost packets
 and leave it up to them to decide what to do. The reason for this is
@@ -43,11 +87,13 @@ it detects lost packets, stops sending new ones and keeps resends the lost one
 until it has a reception confirmation. This creates a pile up of packet data
 which is very much undesirable in high performance, low-latency environments
 like video games. And also the reason why many video games use UDP instead
-of TCP.
+of TCP. Hosts which do want lost messages resent, can use the retransmit
+plugin, which is built on top of this one.
 
 The way this plugin works, should not be confused with guaranteed in-order
 reception of packet data by either end of the connection. This is not what
 we do. For the same reasons as stated in the previous paragraph, this is
-left to the host application.
+left to the host application. The ordered plugin offers it for hosts
+which need it.
 */
 package reliability
@@ -7,10 +7,14 @@ type packetData struct {
 	sequence uint32
 	size     uint32
 	time     float32
+	epoch    uint32 // RTO backoff epoch in which the packet was sent.
 }
 
 // packetQueue holds a list of packets, sorted by sequence number.
-type packetQueue []*packetData
+//
+// Elements are stored by value. This keeps the queues free of
+// per-packet allocations once they have grown to their working size.
+type packetQueue []packetData
 
 // Exists returns true if the given sequence number is present
 // in one of the list's elements.
@@ -38,7 +42,7 @@ func (q *packetQueue) RemoveAt(i int) {
 }
 
 // Insert inserts p ensuring the list remains sorted by sequence number.
-func (q *packetQueue) Insert(p *packetData) {
+func (q *packetQueue) Insert(p packetData) {
 	if len(*q) == 0 {
 		*q = append(*q, p)
 		return
@@ -67,17 +71,16 @@ func (q *packetQueue) Insert(p *packetData) {
 	}
 
 	// Somewhere in between -- Find out where.
-	for i := 1; i < len(tq)-1; i++ {
+	for i := 1; i < len(tq); i++ {
 		if tq[i].sequence == seq {
 			return // Duplicate -- ignore it.
 		}
 
 		if isMoreRecent(tq[i].sequence, seq) {
-			tmp := make(packetQueue, len(tq)+1)
-			copy(tmp, tq[:i])
-			tmp[i] = p
-			copy(tmp[i+1:], tq[i:])
-			*q = tmp
+			tq = append(tq, p)
+			copy(tq[i+1:], tq[i:])
+			tq[i] = p
+			*q = tq
 			return
 		}
 	}
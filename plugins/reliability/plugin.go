@@ -4,109 +4,376 @@
 package reliability
 
 import (
+	"errors"
 	"github.com/jteeuwen/xudp"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var ErrFrequency = errors.New("Polling frequency must be at least 1.")
+
+var (
+	_ xudp.PeerPlugin = (*Plugin)(nil)
+	_ xudp.Controller = (*Plugin)(nil)
+	_ xudp.Ticker     = (*Plugin)(nil)
+)
+
 type PacketFunc func(sequence uint32, addr net.Addr, payload []byte)
 
+// Plugin keeps a separate Reliability instance for each peer.
 type Plugin struct {
-	*Reliability
-	onSent    PacketFunc // Notify the host when a specific packet is sent.
-	onRecv    PacketFunc // Notify the host when a specific packet is received.
-	frequency uint       // Polling frequency for reliability updates.
+	onSent    PacketFunc    // Notify the host when a specific packet is sent.
+	onRecv    PacketFunc    // Notify the host when a specific packet is received.
+	onAcked   SequenceFunc  // Notify the host when a specific packet is ACK'ed.
+	onLost    SequenceFunc  // Notify the host when a specific packet is lost.
+	frequency uint          // Polling frequency for reliability updates.
+	flags     atomic.Uint32 // Flags byte of outgoing headers.
+	mu        sync.Mutex    // Guards the fields below.
+	peers     map[*Reliability]struct{}
+	config    Config        // Retransmission timeout, ACK and header settings.
+	injector  xudp.Injector // Sends standalone ACKs; nil if unregistered.
+	ticked    time.Time     // Time of the previous tick.
 }
 
 // New creates a new reliability plugin.
 //
 // The given handlers optionally notify the host of sent, lost and ACK'ed
-// packets by their sequence number.
+// packets by their sequence number and the address of the peer.
 // 
 // The sent/recv handlers tell the host what sequence number belongs to a given
 // packet. This sequence can be used as a key in a map, keeping track
 // of packet data. The lost and acked handlers only yield this sequence number.
+// Each peer has its own sequence numbers.
 //
-// frequency denotes the number of times per second we should update the
-// internal packet queues. This is necessary to account for packet timeouts
+// frequency denotes the number of times per second the connection should
+// update the internal packet queues. This is necessary to account for packet timeouts
 // and thus accurately determine when a packet is lost or not. 30 times per
 // second is the usual value, but you can adjust it towhatever you want.
+// A frequency of zero is rejected with ErrFrequency when the plugin is
+// opened.
+//
+// ACKs travel in the headers of outgoing packets. When the host has not
+// sent anything to a peer for Config.AckDelay after receiving a packet
+// from it, or has received Config.AckEvery packets in the meantime, the
+// ACKs are sent in a control packet of their own.
 func New(sent, recv PacketFunc, acked, lost SequenceFunc, frequency uint) xudp.Plugin {
 	p := new(Plugin)
-	p.Reliability = NewReliability()
 	p.onSent = sent
 	p.onRecv = recv
 	p.onAcked = acked
 	p.onLost = lost
 	p.frequency = frequency
-	go p.poll()
+	p.peers = make(map[*Reliability]struct{})
 	return p
 }
 
-func (c *Plugin) Open(port int) error { return nil }
-func (c *Plugin) Close() error        { return nil }
+// Open prepares the plugin for a newly opened connection. Sequence numbers
+// and statistics start from scratch, since they are kept for each peer and
+// the connection releases all peers when it closes.
+func (p *Plugin) Open(port int) error {
+	if p.frequency == 0 {
+		return ErrFrequency
+	}
+
+	p.reset()
+	return nil
+}
+
+// Close forgets all peers. The connection stops ticking the plugin.
+func (p *Plugin) Close() error {
+	p.reset()
+	return nil
+}
+
+// reset forgets all peers and the time of the previous tick.
+func (p *Plugin) reset() {
+	p.mu.Lock()
+	clear(p.peers)
+	p.ticked = time.Time{}
+	p.mu.Unlock()
+}
+
+// Peers returns the reliability state of all known peers.
+func (p *Plugin) Peers() []*Reliability {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := make([]*Reliability, 0, len(p.peers))
+
+	for r := range p.peers {
+		list = append(list, r)
+	}
+
+	return list
+}
+
+// SetConfig changes the retransmission timeout, ACK and header settings.
+// Returns ErrConfig, ErrAckDelay or ErrAckMode if they are not valid. The
+// timeouts and ACK delays apply to peers which are created after the call.
+// The ACK mode and sequence number width apply to all subsequent packets.
+//
+// The settings only affect outgoing headers. Peers read each header in
+// the format it was sent in, so both ends may use different settings and
+// change them at any time.
+func (p *Plugin) SetConfig(cfg Config) error {
+	cfg, err := cfg.normalize()
 
-// poll regularly calls update() on the reliability system.
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.config = cfg
+	p.flags.Store(uint32(cfg.flags()))
+	p.mu.Unlock()
+	return nil
+}
+
+// SetInjector sets the injector used to send standalone ACKs.
+func (p *Plugin) SetInjector(inj xudp.Injector) {
+	p.mu.Lock()
+	p.injector = inj
+	p.mu.Unlock()
+}
+
+// TickInterval returns the time between updates, as set by the frequency
+// passed to New.
+func (p *Plugin) TickInterval() time.Duration {
+	if p.frequency == 0 {
+		return 0
+	}
+
+	return time.Second / time.Duration(p.frequency)
+}
+
+// Tick calls update() on the reliability system of each peer.
 // This keeps the ACK handling synchronized, regardless of how often
-// we send/recv data.
-func (p *Plugin) poll() {
-	var prev, curr int64
-	var delta float32
+// we send/recv data. ACKs which have waited too long are flushed.
+func (p *Plugin) Tick(now time.Time) {
+	var flush []net.Addr
+	var lost []lostPacket
+	var seqs []uint32
+
+	p.mu.Lock()
+
+	delta := float32(p.TickInterval().Seconds())
+
+	if !p.ticked.IsZero() {
+		delta = float32(now.Sub(p.ticked).Seconds())
+	}
 
-	tick := time.NewTicker(time.Second / time.Duration(p.frequency))
+	p.ticked = now
+	inj := p.injector
 
-	for {
-		select {
-		case <-tick.C:
-			curr = time.Now().UnixNano()
-			delta = float32(curr-prev) / float32(time.Second)
-			prev = curr
+	for r := range p.peers {
+		r.mu.Lock()
+		seqs = r.update(delta, seqs[:0])
 
-			p.update(delta)
+		if r.ackPending > 0 && r.ackWait >= r.ackDelay {
+			r.ackWait = 0
+			flush = append(flush, r.addr)
 		}
+		r.mu.Unlock()
+
+		for _, seq := range seqs {
+			lost = append(lost, lostPacket{seq, r.addr})
+		}
+	}
+
+	p.mu.Unlock()
+
+	if p.onLost != nil {
+		for _, lp := range lost {
+			p.onLost(lp.sequence, lp.addr)
+		}
+	}
+
+	if inj == nil {
+		return
+	}
+
+	for _, addr := range flush {
+		inj.Inject(addr, nil)
+	}
+}
+
+// lostPacket identifies a packet which was lost on its way to a peer.
+type lostPacket struct {
+	sequence uint32
+	addr     net.Addr
+}
+
+// The flags byte holds the ACK mode in its lowest bits. The next bit
+// selects 16-bit sequence numbers. The remaining bits must be zero.
+const (
+	modeMask    = 0x03
+	flagCompact = 0x04
+	flagsMask   = modeMask | flagCompact
+)
+
+// fieldOffset returns the size of the header fields which precede the
+// ACK field: flags, sequence number and ACK.
+func fieldOffset(flags byte) int {
+	if flags&flagCompact != 0 {
+		return 5
+	}
+
+	return 9
+}
+
+// PayloadSize returns the largest header the plugin writes with any of
+// its settings. It does not change along with them, so SetConfig can be
+// called while packets are being sent. SendPeer only writes as many bytes
+// as the current settings need.
+func (p *Plugin) PayloadSize() int {
+	return fieldOffset(0) + AckRanges.size()
+}
+
+// HeaderSize returns the size of the header at the start of b. Headers
+// in any format are accepted.
+func (p *Plugin) HeaderSize(b []byte) (int, error) {
+	if len(b) == 0 || b[0]&^flagsMask != 0 {
+		return 0, xudp.ErrDiscard
 	}
+
+	offset := fieldOffset(b[0])
+
+	if len(b) < offset {
+		return 0, xudp.ErrDiscard
+	}
+
+	size, ok := fieldSize(AckMode(b[0]&modeMask), b[offset:])
+
+	if !ok {
+		return 0, xudp.ErrDiscard
+	}
+
+	return offset + size, nil
+}
+
+// NewPeer creates the reliability state for a new peer.
+func (p *Plugin) NewPeer(addr net.Addr) interface{} {
+	r := NewReliability()
+	r.addr = addr
+
+	p.mu.Lock()
+	r.configure(p.config, p.TickInterval())
+	p.peers[r] = struct{}{}
+	p.mu.Unlock()
+	return r
+}
+
+// ClosePeer forgets the reliability state of a peer.
+func (p *Plugin) ClosePeer(addr net.Addr, peer interface{}) {
+	p.mu.Lock()
+	delete(p.peers, peer.(*Reliability))
+	p.mu.Unlock()
 }
 
-func (p *Plugin) PayloadSize() int { return 12 }
+// Send and Recv are not called. Packets are handled by SendPeer and
+// RecvPeer instead.
+func (p *Plugin) Send(net.Addr, []byte, int) error { return nil }
+func (p *Plugin) Recv(net.Addr, []byte, int) error { return nil }
 
-func (p *Plugin) Send(addr net.Addr, payload []byte, index int) error {
-	n := p.LocalSequence
-	payload[0] = byte(n >> 24)
-	payload[1] = byte(n >> 16)
-	payload[2] = byte(n >> 8)
-	payload[3] = byte(n)
+// SendPeer writes the sequence number and ACKs for an outgoing packet.
+// Control packets carry the ACKs, but are not sequenced themselves.
+func (p *Plugin) SendPeer(peer interface{}, addr net.Addr, payload []byte, index int) (int, error) {
+	r := peer.(*Reliability)
+	r.mu.Lock()
 
-	n = p.RemoteSequence
-	payload[4] = byte(n >> 24)
-	payload[5] = byte(n >> 16)
-	payload[6] = byte(n >> 8)
-	payload[7] = byte(n)
+	flags := byte(p.flags.Load())
+	r.mode = AckMode(flags & modeMask)
+	sequence := r.stats.LocalSequence
+	field := r.ackVector()
 
-	n = p.ackVector()
-	payload[8] = byte(n >> 24)
-	payload[9] = byte(n >> 16)
-	payload[10] = byte(n >> 8)
-	payload[11] = byte(n)
+	payload[0] = flags
+
+	if flags&flagCompact != 0 {
+		putUint16(payload[1:], uint16(sequence))
+		putUint16(payload[3:], uint16(r.stats.RemoteSequence))
+	} else {
+		putUint32(payload[1:], sequence)
+		putUint32(payload[5:], r.stats.RemoteSequence)
+	}
+
+	offset := fieldOffset(flags)
+	size := offset + field.encode(payload[offset:])
+
+	r.ackPending = 0
+
+	if xudp.IsControl(payload, index) {
+		r.mu.Unlock()
+		return size, nil
+	}
+
+	r.packetSent(uint32(len(payload[index:])))
+	r.mu.Unlock()
 
 	if p.onSent != nil {
-		p.onSent(p.LocalSequence, addr, payload[index:])
+		p.onSent(sequence, addr, payload[index:])
 	}
 
-	p.packetSent(uint32(len(payload[index:])))
-	return nil
+	return size, nil
 }
 
-func (p *Plugin) Recv(addr net.Addr, payload []byte, index int) error {
-	sequence := uint32(payload[0])<<24 | uint32(payload[1])<<16 |
-		uint32(payload[2])<<8 | uint32(payload[3])
+// RecvPeer processes the sequence number and ACKs of an incoming packet.
+// Only the ACKs of control packets are processed. Every Config.AckEvery
+// packets, the ACKs are flushed right away. 16-bit sequence numbers
+// are widened to the nearest 32-bit ones we know of, so the handlers see
+// the same numbers on both ends.
+func (p *Plugin) RecvPeer(peer interface{}, addr net.Addr, payload []byte, index int) error {
+	var field ackField
+	var buf [33]uint32
+	var sequence, ack uint32
+
+	r := peer.(*Reliability)
+	flags := payload[0]
+	offset := fieldOffset(flags)
+	field.decode(AckMode(flags&modeMask), payload[offset:index])
 
-	ack := uint32(payload[4])<<24 | uint32(payload[5])<<16 |
-		uint32(payload[6])<<8 | uint32(payload[7])
+	control := xudp.IsControl(payload, index)
+
+	r.mu.Lock()
+
+	if flags&flagCompact != 0 {
+		sequence = widen(getUint16(payload[1:]), r.stats.RemoteSequence)
+		ack = widen(getUint16(payload[3:]), r.stats.LocalSequence)
+	} else {
+		sequence = getUint32(payload[1:])
+		ack = getUint32(payload[5:])
+	}
 
-	vector := uint32(payload[8])<<24 | uint32(payload[9])<<16 |
-		uint32(payload[10])<<8 | uint32(payload[11])
+	flush := false
 
-	p.packetRecv(sequence, ack, vector, uint32(len(payload[index:])))
+	if !control {
+		r.packetRecv(sequence, uint32(len(payload[index:])))
+		flush = r.ackEvery > 0 && r.ackPending%r.ackEvery == 0
+	}
+
+	acked := r.processAck(ack, &field, buf[:0])
+	r.mu.Unlock()
+
+	if flush {
+		p.mu.Lock()
+		inj := p.injector
+		p.mu.Unlock()
+
+		if inj != nil {
+			inj.Inject(addr, nil)
+		}
+	}
+
+	if p.onAcked != nil {
+		for _, seq := range acked {
+			p.onAcked(seq, addr)
+		}
+	}
+
+	if control {
+		return nil
+	}
 
 	if p.onRecv != nil {
 		p.onRecv(sequence, addr, payload[index:])
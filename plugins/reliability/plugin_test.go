@@ -5,7 +5,10 @@ package reliability
 
 import (
 	"github.com/jteeuwen/xudp"
+	"github.com/jteeuwen/xudp/plugins/protocol"
 	"net"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -27,6 +30,502 @@ func TestConn(t *testing.T) {
 	<-time.After(time.Second / 2)
 }
 
+func TestPeers(t *testing.T) {
+	server := initConn(t, 10015)
+	defer server.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10015}
+
+	for i, port := range []int{10016, 10017} {
+		c := initConn(t, port)
+		defer c.Close()
+
+		for j := 0; j <= i*2; j++ {
+			c.Send(addr, Payload)
+			server.Recv()
+		}
+	}
+
+	plugin := server.Plugins()[0].(*Plugin)
+	peers := plugin.Peers()
+
+	if len(peers) != 2 {
+		t.Fatalf("Expected 2 peers; have %d", len(peers))
+	}
+
+	for _, r := range peers {
+		want := uint32(1)
+
+		if r.Addr().(*net.UDPAddr).Port == 10017 {
+			want = 3
+		}
+
+		st := r.Stats()
+
+		if st.RecvPackets != want || st.RemoteSequence != want-1 {
+			t.Fatalf("%v: Want %d packets, have %d; sequence %d",
+				r.Addr(), want, st.RecvPackets, st.RemoteSequence)
+		}
+	}
+}
+
+func TestStandaloneAck(t *testing.T) {
+	ackc := make(chan uint32, 3)
+
+	ca := xudp.New(1400)
+	ca.Register(New(nil, nil, func(seq uint32, addr net.Addr) { ackc <- seq }, nil, 60))
+
+	err := ca.Open(10018)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb := initConn(t, 10019)
+
+	defer ca.Close()
+	defer cb.Close()
+
+	payloads := make(chan []byte, 6)
+
+	go func() {
+		for {
+			_, payload, err := cb.Recv()
+
+			if err != nil {
+				return
+			}
+
+			payloads <- payload
+		}
+	}()
+
+	// The ACKs arrive in control packets, which yield no payload.
+	go func() {
+		for {
+			_, payload, err := ca.Recv()
+
+			if err != nil {
+				return
+			}
+
+			if payload != nil {
+				t.Errorf("Control packet yielded a payload: %q", payload)
+			}
+		}
+	}()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10019}
+
+	for i := 0; i < 3; i++ {
+		ca.Send(addr, Payload)
+		<-payloads
+	}
+
+	timeout := time.After(time.Second)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ackc:
+		case <-timeout:
+			t.Fatalf("Only %d of 3 packets were ACK'ed", i)
+		}
+	}
+}
+
+func TestAckEvery(t *testing.T) {
+	ackc := make(chan uint32, 4)
+
+	ca := xudp.New(1400)
+	ca.Register(New(nil, nil, func(seq uint32, addr net.Addr) { ackc <- seq }, nil, 60))
+
+	err := ca.Open(10025)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The delay is far too long to matter.
+	plugin := New(nil, nil, nil, nil, 60).(*Plugin)
+	plugin.SetConfig(Config{AckDelay: time.Minute, AckEvery: 2})
+
+	cb := xudp.New(1400)
+	cb.Register(plugin)
+
+	err = cb.Open(10026)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ca.Close()
+	defer cb.Close()
+
+	go func() {
+		for {
+			if _, _, err := ca.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10026}
+
+	ca.Send(addr, Payload)
+	cb.Recv()
+
+	select {
+	case seq := <-ackc:
+		t.Fatalf("Packet %d was ACK'ed before the second one arrived", seq)
+	case <-time.After(time.Second / 5):
+	}
+
+	ca.Send(addr, Payload)
+	cb.Recv()
+
+	timeout := time.After(time.Second)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ackc:
+		case <-timeout:
+			t.Fatalf("Only %d of 2 packets were ACK'ed", i)
+		}
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	before := runtime.NumGoroutine()
+	plugin := New(nil, nil, nil, nil, 1000).(*Plugin)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10020}
+
+	for i := 0; i < 50; i++ {
+		c := xudp.New(1400)
+		c.Register(plugin)
+
+		err := c.Open(10020)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for j := 0; j < 3; j++ {
+			c.Send(addr, Payload)
+			c.Recv()
+		}
+
+		// Sequences start from scratch on each cycle.
+		peers := plugin.Peers()
+
+		if len(peers) != 1 {
+			t.Fatalf("Cycle %d: Want 1 peer, have %d", i, len(peers))
+		}
+
+		if st := peers[0].Stats(); st.LocalSequence != 3 || st.RecvPackets != 3 {
+			t.Fatalf("Cycle %d: Unexpected peer state: %+v", i, st)
+		}
+
+		c.Close()
+
+		if len(plugin.Peers()) != 0 {
+			t.Fatalf("Cycle %d: Peers were not released on Close", i)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Goroutines leaked: %d before, %d after",
+				before, runtime.NumGoroutine())
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestFrequency(t *testing.T) {
+	c := xudp.New(1400)
+	c.Register(New(nil, nil, nil, nil, 0))
+
+	if c.Open(10021) != ErrFrequency {
+		c.Close()
+		t.Fatalf("Invalid frequency was not rejected")
+	}
+}
+
+func TestStats(t *testing.T) {
+	c := initConn(t, 10022)
+	defer c.Close()
+
+	plugin := c.Plugins()[0].(*Plugin)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10022}
+	done := make(chan struct{})
+
+	// Statistics may be read while packets are in flight.
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			for _, r := range plugin.Peers() {
+				r.Stats()
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		c.Send(addr, Payload)
+		c.Recv()
+	}
+
+	<-done
+
+	st := plugin.Peers()[0].Stats()
+
+	if st.SentPackets != 10 || st.RecvPackets != 10 || st.SentBytes != uint64(10*len(Payload)) {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+
+	if st.LossRate() != 0 {
+		t.Fatalf("Unexpected loss rate: %f", st.LossRate())
+	}
+}
+
+func TestAckModes(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10023}
+
+	for mode := Ack32; mode < ackModes; mode++ {
+		plugin := New(nil, nil, nil, nil, 60).(*Plugin)
+		plugin.SetConfig(Config{AckMode: mode})
+
+		c := xudp.New(1400)
+		c.Register(plugin)
+
+		err := c.Open(10023)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// One more byte goes to the control flag. Room is reserved for
+		// the largest header in any mode.
+		if c.PayloadSize() != 1400-xudp.UDPHeaderSize-fieldOffset(0)-AckRanges.size()-1 {
+			t.Errorf("Mode %d: Unexpected payload size %d", mode, c.PayloadSize())
+		}
+
+		// Each packet ACKs the ones before it.
+		for i := 0; i < 10; i++ {
+			c.Send(addr, Payload)
+			c.Recv()
+		}
+
+		st := plugin.Peers()[0].Stats()
+		c.Close()
+
+		if st.AckedPackets != 9 {
+			t.Fatalf("Mode %d: Want 9 ACK'ed packets, have %d", mode, st.AckedPackets)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	var seqs []uint32
+
+	recv := func(seq uint32, addr net.Addr, payload []byte) { seqs = append(seqs, seq) }
+
+	pa := New(nil, nil, nil, nil, 30).(*Plugin)
+	pb := New(nil, recv, nil, nil, 30).(*Plugin)
+	pa.SetConfig(Config{Compact: true})
+	pb.SetConfig(Config{Compact: true})
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10024}
+	ra := pa.NewPeer(addr).(*Reliability)
+	rb := pb.NewPeer(addr).(*Reliability)
+
+	// Sequence numbers run past the 16-bit range.
+	ra.stats.LocalSequence = MaxSequence16 - 2
+	rb.stats.RemoteSequence = MaxSequence16 - 3
+
+	for i := 0; i < 6; i++ {
+		buf := make([]byte, pa.PayloadSize()+1+len(Payload))
+		index := pa.PayloadSize() + 1
+		copy(buf[index:], Payload)
+
+		n, err := pa.SendPeer(ra, addr, buf, index)
+
+		if err != nil || n != 9 {
+			t.Fatalf("Unexpected header size %d, %v", n, err)
+		}
+
+		// Move the header up to the control flag, as the connection does.
+		packet := append(buf[:n:n], buf[index-1:]...)
+
+		if size, err := pb.HeaderSize(packet); err != nil || size != n {
+			t.Fatalf("Header size mismatch: Want %d, got %d, %v", n, size, err)
+		}
+
+		err = pb.RecvPeer(rb, addr, packet, n+1)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(seqs) != 6 {
+		t.Fatalf("Want 6 packets, got %d", len(seqs))
+	}
+
+	for i, seq := range seqs {
+		if want := MaxSequence16 - 2 + uint32(i); seq != want {
+			t.Fatalf("Packet %d: Want sequence %d, got %d", i, want, seq)
+		}
+	}
+
+	// The ACKs are widened the same way.
+	buf := make([]byte, pb.PayloadSize()+1)
+	n, _ := pb.SendPeer(rb, addr, buf, len(buf))
+	pa.RecvPeer(ra, addr, append(buf[:n:n], 0), n+1)
+
+	if st := ra.Stats(); st.AckedPackets != 6 {
+		t.Fatalf("Want 6 ACK'ed packets, have %d", st.AckedPackets)
+	}
+
+	// A compact peer reads full-size headers as well.
+	pa.SetConfig(Config{})
+	buf = make([]byte, pa.PayloadSize()+1)
+	n, _ = pa.SendPeer(ra, addr, buf, len(buf))
+
+	if size, err := pb.HeaderSize(buf[:n]); err != nil || size != 13 {
+		t.Fatalf("Full-size header was not accepted: %d, %v", size, err)
+	}
+}
+
+// TestConfigRace changes the ACK mode and sequence number width while
+// packets are being sent.
+func TestConfigRace(t *testing.T) {
+	var wg sync.WaitGroup
+
+	plugin := New(nil, nil, nil, nil, 60).(*Plugin)
+
+	c := xudp.New(1400)
+	c.Register(plugin)
+
+	err := c.Open(10027)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+	go func() {
+		for {
+			if _, _, err := c.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10027}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if err := c.Send(addr, Payload); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second / 5)
+
+	for i := 0; time.Now().Before(deadline); i++ {
+		plugin.SetConfig(Config{
+			AckMode: AckMode(i) % ackModes,
+			Compact: i/int(ackModes)%2 == 0,
+		})
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+func BenchmarkRecvInto(b *testing.B) {
+	c := initBenchConn(b, 10013)
+	defer c.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10013}
+	buf := make([]byte, c.PayloadSize())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := c.Send(addr, Payload)
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_, _, err = c.RecvInto(buf)
+
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRecvPacket(b *testing.B) {
+	c := initBenchConn(b, 10014)
+	defer c.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10014}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := c.Send(addr, Payload)
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		p, err := c.RecvPacket()
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		p.Release()
+	}
+}
+
+func initBenchConn(b *testing.B, port int) *xudp.Connection {
+	c := xudp.New(1400)
+	c.Register(protocol.New(0xBADBEEF))
+	c.Register(New(nil, nil, nil, nil, 30))
+
+	err := c.Open(port)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return c
+}
+
 func loop(t *testing.T, c *xudp.Connection) {
 	tick := time.NewTicker(time.Second / 30)
 
@@ -83,10 +582,10 @@ func recv(seq uint32, addr net.Addr, payload []byte) {
 	//println("recv", seq)
 }
 
-func lost(seq uint32) {
+func lost(seq uint32, addr net.Addr) {
 	//println("lost", seq)
 }
 
-func acked(seq uint32) {
+func acked(seq uint32, addr net.Addr) {
 	//println("ACK'ed", seq)
 }
@@ -3,14 +3,48 @@
 
 package reliability
 
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Seconds over which the bandwidth is measured.
+const window = 1
+
 // Maximum packet sequence value.	
 const MaxSequence = 1<<32 - 1
 
+// Maximum packet sequence value in compact headers.
+const MaxSequence16 = 1<<16 - 1
+
 // isMoreRecent checks if sequence a is newer than sequence b,
 // while taking integer overflow into account.
 func isMoreRecent(a, b uint32) bool {
-	const max = MaxSequence >> 1
-	return (a > b) && (a-b <= max) || (b > a) && (b-a > max)
+	return moreRecent(a, b, MaxSequence)
+}
+
+// moreRecent checks if sequence a is newer than sequence b, where
+// sequence numbers wrap around after max.
+func moreRecent(a, b, max uint32) bool {
+	half := max >> 1
+	return (a > b) && (a-b <= half) || (b > a) && (b-a > half)
+}
+
+// widen returns the 32-bit sequence number nearest to ref, whose lower
+// 16 bits equal seq.
+func widen(seq uint16, ref uint32) uint32 {
+	wide := ref&^MaxSequence16 | uint32(seq)
+
+	if moreRecent(uint32(seq), ref&MaxSequence16, MaxSequence16) {
+		if wide < ref {
+			wide += MaxSequence16 + 1
+		}
+	} else if wide > ref {
+		wide -= MaxSequence16 + 1
+	}
+
+	return wide
 }
 
 // bitIndex finds the ack vector bit index for the given sequence number.
@@ -21,103 +55,165 @@ func bitIndex(sequence, ack uint32) uint32 {
 	return ack - 1 - sequence
 }
 
-type SequenceFunc func(sequence uint32)
+type SequenceFunc func(sequence uint32, addr net.Addr)
+
+// Stats holds the statistics of a Reliability instance at a single
+// point in time.
+type Stats struct {
+	SentBytes      uint64  // Number of bytes sent.
+	RecvBytes      uint64  // Number of bytes received.
+	SentPackets    uint32  // Number of packets sent.
+	RecvPackets    uint32  // Number of packets received.
+	LostPackets    uint32  // Number of packets lost.
+	AckedPackets   uint32  // Number of packets ACK'ed.
+	LocalSequence  uint32  // Local sequence number for the next packet to be sent.
+	RemoteSequence uint32  // Remote sequence number for most recently received packet.
+	SentBandwidth  float32 // Approximate sent bandwidth over the last second.
+	AckedBandwidth float32 // Approximate ACK'ed bandwidth over the last second.
+	RTT            float32 // Smoothed round trip time in seconds.
+	RTTVar         float32 // Round trip time variation in seconds.
+	RTO            float32 // Seconds after which an unacknowledged packet is lost.
+}
+
+// LossRate returns the fraction of sent packets which were lost.
+func (s Stats) LossRate() float32 {
+	if s.SentPackets == 0 {
+		return 0
+	}
+
+	return float32(s.LostPackets) / float32(s.SentPackets)
+}
 
 // Reliability implements the algorithms needed to make a reliable connection
 // reliable. This means it manages sent, received, pending ACKs and ACK'ed
 // packet queues. In addtion, it tracks bandwidth use and round trip timing.
+//
+// It is safe for concurrent use. Use Stats to read its statistics.
 type Reliability struct {
-	onAcked         SequenceFunc // Notify the host when a specific packet is ACK'ed.
-	onLost          SequenceFunc // Notify the host when a specific packet is lost.
-	sentQueue       packetQueue  // Sent packets used to calculate sent bandwidth.
-	pendingAckQueue packetQueue  // Sent packets which have not been acked yet.
-	recvQueue       packetQueue  // Received packets used to determine acks to send.
-	ackedQueue      packetQueue  // ACK'ed packets.
-	SentBytes       uint64       // Number of bytes sent.
-	RecvBytes       uint64       // Number of bytes received.
-	SentPackets     uint32       // Number of packets sent.
-	RecvPackets     uint32       // Number of packets received.
-	LostPackets     uint32       // Number of packets lost.
-	AckedPackets    uint32       // Number of packets ACK'ed.
-	LocalSequence   uint32       // Local sequence number for most recently sent packet.
-	RemoteSequence  uint32       // Remote sequence number for most recently received packet.
-	SentBandwidth   float32      // Approximate sent bandwidth over the last second.
-	AckedBandwidth  float32      // Approximate ACK'ed bandwidth over the last second.
-	RTT             float32      // Estimated round trip time.
-	RTTMax          float32      // Maximum expected round trip time.
+	addr            net.Addr    // Address of the peer.
+	mu              sync.Mutex  // Guards the fields below.
+	sentQueue       packetQueue // Sent packets used to calculate sent bandwidth.
+	pendingAckQueue packetQueue // Sent packets which have not been acked yet.
+	recvQueue       packetQueue // Received packets used to determine acks to send.
+	ackedQueue      packetQueue // ACK'ed packets.
+	stats           Stats
+	rto             rtoEstimator
+	mode            AckMode // Format of the ACKs sent to the peer.
+	ackWait         float32 // Seconds the oldest unsent ACK has waited.
+	ackPending      uint32  // Received packets which have not been ACK'ed yet.
+	ackDelay        float32 // Seconds an ACK may wait for an outgoing packet.
+	ackEvery        uint32  // Received packets which force an ACK; 0 if unused.
 }
 
-// NewReliability creates a new reliability instance.
+// NewReliability creates a new reliability instance with the default
+// configuration.
 func NewReliability() *Reliability {
 	r := new(Reliability)
+	r.configure(Config{}, 0)
 	r.reset()
 	return r
 }
 
+// configure applies the given configuration. The granularity is the time
+// between updates of the packet queues.
+func (r *Reliability) configure(cfg Config, granularity time.Duration) {
+	cfg, _ = cfg.normalize()
+	r.rto.init(cfg, granularity)
+	r.mode = cfg.AckMode
+	r.ackDelay = float32(cfg.AckDelay.Seconds())
+	r.ackEvery = uint32(cfg.AckEvery)
+}
+
+// Stats returns a snapshot of the current statistics.
+func (r *Reliability) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st := r.stats
+	st.RTT = r.rto.srtt
+	st.RTTVar = r.rto.rttvar
+	st.RTO = r.rto.rto
+	return st
+}
+
 // packetSent is called whenever a new packet is sent.
 func (r *Reliability) packetSent(size uint32) {
-	pd := &packetData{
-		sequence: r.LocalSequence,
+	pd := packetData{
+		sequence: r.stats.LocalSequence,
 		size:     size,
+		epoch:    r.rto.epoch,
 	}
 
 	r.sentQueue = append(r.sentQueue, pd)
 	r.pendingAckQueue = append(r.pendingAckQueue, pd)
-	r.SentPackets++
-	r.LocalSequence++
-	r.SentBytes += uint64(size)
+	r.stats.SentPackets++
+	r.stats.LocalSequence++
+	r.stats.SentBytes += uint64(size)
 }
 
 // packetRecv is called whenever a new packet is received.
-func (r *Reliability) packetRecv(sequence, ack, vector, size uint32) {
-	defer r.processAck(ack, vector)
-
-	r.RecvPackets++
-	r.RecvBytes += uint64(size)
+// Its ACKs are handled separately by processAck.
+func (r *Reliability) packetRecv(sequence, size uint32) {
+	r.stats.RecvPackets++
+	r.stats.RecvBytes += uint64(size)
 
-	if r.recvQueue.Exists(sequence) {
-		return
+	if r.ackPending == 0 {
+		r.ackWait = 0
 	}
 
-	r.recvQueue = append(r.recvQueue, &packetData{
+	r.ackPending++
+
+	// Packets can arrive out of order. Keep the queue sorted, so the ACK
+	// field and the trimming in updateQueues see them in sequence.
+	r.recvQueue.Insert(packetData{
 		sequence: sequence,
 		size:     size,
 	})
 
-	if isMoreRecent(sequence, r.RemoteSequence) {
-		r.RemoteSequence = sequence
+	if isMoreRecent(sequence, r.stats.RemoteSequence) {
+		r.stats.RemoteSequence = sequence
 	}
 }
 
-// ackVector generates the ACK vector which should be included in an
-// outgoing packet header.
-func (r *Reliability) ackVector() uint32 {
-	var vector, bit uint32
+// ackVector generates the ACK field which should be included in an
+// outgoing packet header, in the peer's ACK mode.
+func (r *Reliability) ackVector() (f ackField) {
+	f.mode = r.mode
+	ack := r.stats.RemoteSequence
 
-	ack := r.RemoteSequence
+	// Walk from the most recent packet back, so bits are set in
+	// increasing order. Packets which do not fit in the field, are
+	// left out.
+	for i := len(r.recvQueue) - 1; i >= 0; i-- {
+		seq := r.recvQueue[i].sequence
 
-	for _, pd := range r.recvQueue {
-		if pd.sequence == ack || isMoreRecent(pd.sequence, ack) {
-			break
+		if seq == ack || isMoreRecent(seq, ack) {
+			continue
 		}
 
-		bit = bitIndex(pd.sequence, ack)
-
-		if bit <= 31 {
-			vector |= 1 << bit
-		}
+		f.set(bitIndex(seq, ack))
 	}
 
-	return vector
+	return
 }
 
 // update takes a frame time delta and updates packet timeouts with it.
-func (r *Reliability) update(delta float32) {
+// The sequence numbers of packets which are now considered lost, are
+// appended to lost.
+func (r *Reliability) update(delta float32, lost []uint32) []uint32 {
+	if r.ackPending > 0 {
+		r.ackWait += delta
+	}
+
 	r.advanceQueueTime(delta)
-	r.updateQueues()
+	lost = r.updateQueues(lost)
 	r.updateStats()
+	return lost
 }
 
+// Addr returns the address of the peer this state belongs to.
+func (r *Reliability) Addr() net.Addr { return r.addr }
+
 // Reset sets the Reliability system to its initial state.
 func (r *Reliability) reset() {
 	r.sentQueue = r.sentQueue[:0]
@@ -125,57 +221,47 @@ func (r *Reliability) reset() {
 	r.pendingAckQueue = r.pendingAckQueue[:0]
 	r.ackedQueue = r.ackedQueue[:0]
 
-	r.LocalSequence = 0
-	r.RemoteSequence = 0
-	r.SentPackets = 0
-	r.RecvPackets = 0
-	r.LostPackets = 0
-	r.AckedPackets = 0
-	r.SentBandwidth = 0
-	r.AckedBandwidth = 0
-	r.RTT = 0
-	r.RTTMax = 1
+	r.stats = Stats{}
+	r.rto.reset()
+	r.ackWait = 0
+	r.ackPending = 0
 }
 
-// processAck handles a single incoming ACK with ACK vector.
-func (r *Reliability) processAck(ack, vector uint32) {
+// processAck handles a single incoming ACK with its ACK field.
+// The sequence numbers of newly ACK'ed packets are appended to acked.
+func (r *Reliability) processAck(ack uint32, field *ackField, acked []uint32) []uint32 {
 	if len(r.pendingAckQueue) == 0 {
-		return
+		return acked
 	}
 
-	var pd *packetData
-	var acked bool
-	var bit uint32
+	var pd packetData
+	var ok bool
 
 	for i := 0; i < len(r.pendingAckQueue); i++ {
 		pd = r.pendingAckQueue[i]
-		acked = false
+		ok = false
 
 		if pd.sequence == ack {
-			acked = true
+			ok = true
 
 		} else if isMoreRecent(ack, pd.sequence) {
-			bit = bitIndex(pd.sequence, ack)
-
-			if bit <= 31 {
-				acked = (vector>>bit)&1 != 0
-			}
+			ok = field.has(bitIndex(pd.sequence, ack))
 		}
 
-		if !acked {
+		if !ok {
 			continue
 		}
 
-		r.RTT += (pd.time - r.RTT) * 0.1
+		r.rto.sample(pd.time, pd.epoch)
 		r.ackedQueue.Insert(pd)
-		r.AckedPackets++
+		r.stats.AckedPackets++
 		r.pendingAckQueue.RemoveAt(i)
 		i--
 
-		if r.onAcked != nil {
-			r.onAcked(pd.sequence)
-		}
+		acked = append(acked, pd.sequence)
 	}
+
+	return acked
 }
 
 // AdvanceQueueTime updates the timestamp for each queued packet.
@@ -205,51 +291,55 @@ func (r *Reliability) advanceQueueTime(delta float32) {
 
 // updateQueues updates all queues to discard packets that have
 // exceeded their timeouts or are otherwise no longer necessary.
-func (r *Reliability) updateQueues() {
+// Packets which have not been ACK'ed within the RTO are lost. Their
+// sequence numbers are appended to lost and the RTO is backed off.
+func (r *Reliability) updateQueues(lost []uint32) []uint32 {
 	const epsilon = 0.001
 
 	if len(r.recvQueue) > 0 {
-		var minSeq uint32
+		// Keep enough packets to fill the ACK field. The subtraction
+		// wraps around along with the sequence numbers.
 		lastSeq := r.recvQueue[len(r.recvQueue)-1].sequence
-
-		if lastSeq >= 34 {
-			minSeq = lastSeq - 34
-		} else {
-			minSeq = MaxSequence - (34 - lastSeq)
-		}
+		minSeq := lastSeq - (r.mode.window() + 2)
 
 		for len(r.recvQueue) > 0 && isMoreRecent(minSeq, r.recvQueue[0].sequence) {
 			r.recvQueue = r.recvQueue[1:]
 		}
 	}
 
-	threshold := r.RTTMax + epsilon
+	threshold := float32(window + epsilon)
 	for len(r.sentQueue) > 0 && r.sentQueue[0].time > threshold {
 		r.sentQueue = r.sentQueue[1:]
 	}
 
-	for len(r.pendingAckQueue) > 0 && r.pendingAckQueue[0].time > threshold {
-		if r.onLost != nil {
-			r.onLost(r.pendingAckQueue[0].sequence)
-		}
+	n := len(lost)
+	threshold = r.rto.rto + epsilon
 
+	for len(r.pendingAckQueue) > 0 && r.pendingAckQueue[0].time > threshold {
+		lost = append(lost, r.pendingAckQueue[0].sequence)
 		r.pendingAckQueue = r.pendingAckQueue[1:]
-		r.LostPackets++
+		r.stats.LostPackets++
 	}
 
-	threshold = r.RTTMax*2 - epsilon
+	if len(lost) > n {
+		r.rto.backoff()
+	}
+
+	threshold = window*2 - epsilon
 	for len(r.ackedQueue) > 0 && r.ackedQueue[0].time > threshold {
 		r.ackedQueue = r.ackedQueue[1:]
 	}
+
+	return lost
 }
 
 // updateStats updates bandwidth and timing statistics.
 func (r *Reliability) updateStats() {
 	var ackedBytes float32
 	var sentBytes float32
-	var pd *packetData
+	var pd packetData
 
-	rm := r.RTTMax
+	rm := float32(window)
 
 	for _, pd = range r.sentQueue {
 		sentBytes += float32(pd.size)
@@ -264,6 +354,6 @@ func (r *Reliability) updateStats() {
 	sentBytes /= rm
 	ackedBytes /= rm
 
-	r.SentBandwidth = sentBytes * (8 / 1000.0)
-	r.AckedBandwidth = ackedBytes * (8 / 1000.0)
+	r.stats.SentBandwidth = sentBytes * (8 / 1000.0)
+	r.stats.AckedBandwidth = ackedBytes * (8 / 1000.0)
 }
@@ -27,11 +27,61 @@ func TestBitIndex(t *testing.T) {
 	}
 }
 
+func TestMoreRecent(t *testing.T) {
+	tests := []struct {
+		a, b, max uint32
+		want      bool
+	}{
+		{1, 0, MaxSequence, true},
+		{0, 1, MaxSequence, false},
+		{0, MaxSequence, MaxSequence, true},
+		{MaxSequence, 0, MaxSequence, false},
+		{MaxSequence / 2, 0, MaxSequence, true},
+		{MaxSequence/2 + 1, 0, MaxSequence, false},
+		{1, 0, MaxSequence16, true},
+		{0, MaxSequence16, MaxSequence16, true},
+		{MaxSequence16, 0, MaxSequence16, false},
+		{5, MaxSequence16 - 5, MaxSequence16, true},
+		{MaxSequence16 / 2, 0, MaxSequence16, true},
+		{MaxSequence16/2 + 1, 0, MaxSequence16, false},
+		{7, 7, MaxSequence16, false},
+	}
+
+	for _, mt := range tests {
+		if moreRecent(mt.a, mt.b, mt.max) != mt.want {
+			t.Fatalf("%d newer than %d (max %d): Want %v", mt.a, mt.b, mt.max, mt.want)
+		}
+	}
+}
+
+func TestWiden(t *testing.T) {
+	tests := []struct {
+		seq       uint16
+		ref, want uint32
+	}{
+		{0, 0, 0},
+		{5, 0, 5},
+		{MaxSequence16, 0, MaxSequence},
+		{5, MaxSequence16 - 3, MaxSequence16 + 6},
+		{MaxSequence16 - 3, MaxSequence16 + 6, MaxSequence16 - 3},
+		{0x1234, 0x51230, 0x51234},
+		{0x1230, 0x51234, 0x51230},
+		{5, MaxSequence - 3, 5},
+		{MaxSequence16 - 3, 5, MaxSequence - 3},
+	}
+
+	for _, wt := range tests {
+		if got := widen(wt.seq, wt.ref); got != wt.want {
+			t.Fatalf("Widen %d near %d: Want %d, got %d", wt.seq, wt.ref, wt.want, got)
+		}
+	}
+}
+
 func TestAckVector(t *testing.T) {
 	r := NewReliability()
 
 	for i := 0; i < 32; i++ {
-		r.recvQueue.Insert(&packetData{sequence: uint32(i)})
+		r.recvQueue.Insert(packetData{sequence: uint32(i)})
 	}
 
 	tests := [][2]uint32{
@@ -43,8 +93,8 @@ func TestAckVector(t *testing.T) {
 	}
 
 	for _, bt := range tests {
-		r.RemoteSequence = bt[0]
-		vector := r.ackVector()
+		r.stats.RemoteSequence = bt[0]
+		vector := uint32(r.ackVector().bits[0])
 
 		if vector != bt[1] {
 			t.Errorf("Ack %d. Want 0x%08x, Got 0x%08x", bt[0], bt[1], vector)
@@ -55,9 +105,9 @@ func TestAckVector(t *testing.T) {
 func TestAckVectorWrapped(t *testing.T) {
 	r := NewReliability()
 
-	r.recvQueue.Insert(&packetData{sequence: MaxSequence - 1})
-	r.recvQueue.Insert(&packetData{sequence: MaxSequence})
-	r.recvQueue.Insert(&packetData{sequence: 0})
+	r.recvQueue.Insert(packetData{sequence: MaxSequence - 1})
+	r.recvQueue.Insert(packetData{sequence: MaxSequence})
+	r.recvQueue.Insert(packetData{sequence: 0})
 
 	tests := [][2]uint32{
 		{0, 0x3},
@@ -71,8 +121,8 @@ func TestAckVectorWrapped(t *testing.T) {
 	}
 
 	for _, bt := range tests {
-		r.RemoteSequence = bt[0]
-		vector := r.ackVector()
+		r.stats.RemoteSequence = bt[0]
+		vector := uint32(r.ackVector().bits[0])
 
 		if vector != bt[1] {
 			t.Errorf("Ack %d. Want 0x%08x, Got 0x%08x", bt[0], bt[1], vector)
@@ -80,19 +130,44 @@ func TestAckVectorWrapped(t *testing.T) {
 	}
 }
 
+func TestAckVectorOutOfOrder(t *testing.T) {
+	r := NewReliability()
+
+	for _, seq := range []uint32{5, 1, 39, 3, 0, 2, 40, 4, 6} {
+		r.packetRecv(seq, 0)
+	}
+
+	if !isQueueSorted(r.recvQueue) || len(r.recvQueue) != 9 {
+		t.Fatalf("Receive queue is not sorted: %v", r.recvQueue)
+	}
+
+	// Packets 0 to 6 are more than 32 behind the ACK, but 39 is not.
+	r.mode = Ack32
+
+	if vector := uint32(r.ackVector().bits[0]); vector != 0x1 {
+		t.Fatalf("Want 0x00000001, Got 0x%08x", vector)
+	}
+
+	r.mode = Ack64
+
+	if vector := r.ackVector().bits[0]; vector != 0xfe00000001 {
+		t.Fatalf("Want 0xfe00000001, Got 0x%x", vector)
+	}
+}
+
 func TestprocessAck1(t *testing.T) {
 	r := NewReliability()
 
 	for i := 0; i < 33; i++ {
-		r.pendingAckQueue.Insert(&packetData{sequence: uint32(i)})
+		r.pendingAckQueue.Insert(packetData{sequence: uint32(i)})
 	}
 
-	r.RTT = 0
-	r.AckedPackets = 0
-	r.processAck(32, 0xffffffff)
+	r.stats.RTT = 0
+	r.stats.AckedPackets = 0
+	r.processAck(32, vector32(0xffffffff), nil)
 
-	if r.AckedPackets != 33 {
-		t.Fatalf("AckedPackets mismatch: Want 33, got %d", r.AckedPackets)
+	if r.stats.AckedPackets != 33 {
+		t.Fatalf("AckedPackets mismatch: Want 33, got %d", r.stats.AckedPackets)
 	}
 
 	if len(r.ackedQueue) != 33 {
@@ -118,16 +193,16 @@ func TestprocessAck2(t *testing.T) {
 	r := NewReliability()
 
 	for i := 0; i < 33; i++ {
-		r.pendingAckQueue.Insert(&packetData{sequence: uint32(i)})
+		r.pendingAckQueue.Insert(packetData{sequence: uint32(i)})
 	}
 
-	r.RTT = 0
-	r.AckedPackets = 0
-	r.processAck(32, 0x0000ffff)
+	r.stats.RTT = 0
+	r.stats.AckedPackets = 0
+	r.processAck(32, vector32(0x0000ffff), nil)
 
 	n := 17
-	if r.AckedPackets != uint32(n) {
-		t.Fatalf("AckedPackets mismatch: Want %d, got %d", n, r.AckedPackets)
+	if r.stats.AckedPackets != uint32(n) {
+		t.Fatalf("AckedPackets mismatch: Want %d, got %d", n, r.stats.AckedPackets)
 	}
 
 	if len(r.ackedQueue) != n {
@@ -160,16 +235,16 @@ func TestprocessAck3(t *testing.T) {
 	r := NewReliability()
 
 	for i := 0; i < 32; i++ {
-		r.pendingAckQueue.Insert(&packetData{sequence: uint32(i)})
+		r.pendingAckQueue.Insert(packetData{sequence: uint32(i)})
 	}
 
-	r.RTT = 0
-	r.AckedPackets = 0
-	r.processAck(48, 0xffff0000)
+	r.stats.RTT = 0
+	r.stats.AckedPackets = 0
+	r.processAck(48, vector32(0xffff0000), nil)
 
 	n := 16
-	if r.AckedPackets != uint32(n) {
-		t.Fatalf("AckedPackets mismatch: Want %d, got %d", n, r.AckedPackets)
+	if r.stats.AckedPackets != uint32(n) {
+		t.Fatalf("AckedPackets mismatch: Want %d, got %d", n, r.stats.AckedPackets)
 	}
 
 	if len(r.ackedQueue) != n {
@@ -196,3 +271,8 @@ func TestprocessAck3(t *testing.T) {
 		}
 	}
 }
+
+// vector32 returns a 32-bit ACK field holding the given vector.
+func vector32(v uint32) *ackField {
+	return &ackField{mode: Ack32, bits: [2]uint64{uint64(v)}}
+}
@@ -0,0 +1,158 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package reliability
+
+import (
+	"errors"
+	"time"
+)
+
+// Default bounds for the retransmission timeout. The minimum is well below
+// the one second RFC 6298 asks for, so losses on fast links are reported
+// in good time.
+const (
+	DefaultMinRTO     = 100 * time.Millisecond
+	DefaultMaxRTO     = 60 * time.Second
+	DefaultInitialRTO = time.Second
+)
+
+// Default time an ACK waits for an outgoing packet to carry it.
+const DefaultAckDelay = 20 * time.Millisecond
+
+var (
+	ErrConfig   = errors.New("Retransmission timeouts must satisfy 0 < MinRTO <= InitialRTO <= MaxRTO.")
+	ErrAckDelay = errors.New("AckDelay and AckEvery must not be negative.")
+)
+
+// Config holds the settings for the retransmission timeout of each peer,
+// for its ACKs and for the headers sent to it. Durations which are left
+// zero, select their default value.
+type Config struct {
+	MinRTO     time.Duration // Lower bound for the timeout.
+	MaxRTO     time.Duration // Upper bound for the timeout.
+	InitialRTO time.Duration // Timeout until the round trip time has been measured.
+	AckDelay   time.Duration // Time an ACK waits for an outgoing packet, before it is sent by itself.
+	AckEvery   int           // Number of received packets after which ACKs are sent right away; 0 to only use AckDelay.
+	AckMode    AckMode       // Format of the ACKs sent to peers.
+	Compact    bool          // Send 16-bit sequence numbers instead of 32-bit ones.
+}
+
+// normalize fills in the defaults and validates the result.
+func (c Config) normalize() (Config, error) {
+	if c.MinRTO == 0 {
+		c.MinRTO = DefaultMinRTO
+	}
+
+	if c.MaxRTO == 0 {
+		c.MaxRTO = DefaultMaxRTO
+	}
+
+	if c.InitialRTO == 0 {
+		c.InitialRTO = DefaultInitialRTO
+	}
+
+	if c.AckDelay == 0 {
+		c.AckDelay = DefaultAckDelay
+	}
+
+	if c.MinRTO < 0 || c.MinRTO > c.InitialRTO || c.InitialRTO > c.MaxRTO {
+		return c, ErrConfig
+	}
+
+	if c.AckDelay < 0 || c.AckEvery < 0 {
+		return c, ErrAckDelay
+	}
+
+	if c.AckMode >= ackModes {
+		return c, ErrAckMode
+	}
+
+	return c, nil
+}
+
+// flags returns the flags byte of the headers described by c.
+func (c Config) flags() byte {
+	flags := byte(c.AckMode)
+
+	if c.Compact {
+		flags |= flagCompact
+	}
+
+	return flags
+}
+
+// rtoEstimator tracks the round trip time to a peer and derives the
+// retransmission timeout (RTO) from it, as described by RFC 6298.
+// All values are in seconds.
+//
+// Samples obey Karn's rule: once a timeout has backed off the RTO, the
+// ACKs of packets sent before that are ambiguous. They may have been held
+// up by whatever caused the loss, so they are not sampled. The backed off
+// RTO is kept until a packet sent after it is ACK'ed.
+type rtoEstimator struct {
+	min, max    float32 // Bounds for the RTO.
+	initial     float32 // RTO until the first sample.
+	granularity float32 // Resolution of the round trip times.
+	srtt        float32 // Smoothed round trip time.
+	rttvar      float32 // Round trip time variation.
+	rto         float32 // Current retransmission timeout.
+	sampled     bool    // At least one sample was taken.
+	epoch       uint32  // Number of times the RTO was backed off.
+}
+
+// init applies the given configuration and resets the estimator. The
+// granularity is the time between updates of the packet queues.
+func (e *rtoEstimator) init(cfg Config, granularity time.Duration) {
+	cfg, _ = cfg.normalize()
+	e.min = float32(cfg.MinRTO.Seconds())
+	e.max = float32(cfg.MaxRTO.Seconds())
+	e.initial = float32(cfg.InitialRTO.Seconds())
+	e.granularity = float32(granularity.Seconds())
+	e.reset()
+}
+
+// reset forgets all samples.
+func (e *rtoEstimator) reset() {
+	e.srtt = 0
+	e.rttvar = 0
+	e.rto = e.initial
+	e.sampled = false
+	e.epoch = 0
+}
+
+// sample updates the estimate with the round trip time of a packet sent
+// during the given epoch. Ambiguous samples are ignored.
+func (e *rtoEstimator) sample(rtt float32, epoch uint32) {
+	if epoch != e.epoch {
+		return
+	}
+
+	if !e.sampled {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.sampled = true
+	} else {
+		diff := e.srtt - rtt
+
+		if diff < 0 {
+			diff = -diff
+		}
+
+		e.rttvar = 0.75*e.rttvar + 0.25*diff
+		e.srtt = 0.875*e.srtt + 0.125*rtt
+	}
+
+	e.rto = e.clamp(e.srtt + max(e.granularity, 4*e.rttvar))
+}
+
+// backoff doubles the RTO after a packet was lost.
+func (e *rtoEstimator) backoff() {
+	e.rto = e.clamp(e.rto * 2)
+	e.epoch++
+}
+
+// clamp bounds the given RTO.
+func (e *rtoEstimator) clamp(rto float32) float32 {
+	return min(max(rto, e.min), e.max)
+}
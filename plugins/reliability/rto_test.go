@@ -0,0 +1,127 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package reliability
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTOSample(t *testing.T) {
+	var e rtoEstimator
+	e.init(Config{MinRTO: time.Millisecond * 10}, 0)
+
+	if e.rto != 1 {
+		t.Fatalf("Initial RTO mismatch: Want 1, got %f", e.rto)
+	}
+
+	tests := [][3]float32{
+		// sample, srtt, rto
+		{0.1, 0.1, 0.3},
+		{0.1, 0.1, 0.25},
+		{0.2, 0.1125, 0.1125 + 4*0.053125},
+	}
+
+	for i, rt := range tests {
+		e.sample(rt[0], 0)
+
+		if !near(e.srtt, rt[1]) || !near(e.rto, rt[2]) {
+			t.Fatalf("Sample %d: Want srtt %f, rto %f; got %f, %f",
+				i, rt[1], rt[2], e.srtt, e.rto)
+		}
+	}
+}
+
+func TestRTOBounds(t *testing.T) {
+	var e rtoEstimator
+	e.init(Config{MaxRTO: time.Second * 3}, time.Second/30)
+
+	// Tiny samples are bounded by the granularity and the minimum.
+	e.sample(0.001, 0)
+
+	if !near(e.rto, float32(DefaultMinRTO.Seconds())) {
+		t.Fatalf("RTO below minimum: %f", e.rto)
+	}
+
+	e.backoff()
+	e.backoff()
+	e.backoff()
+	e.backoff()
+	e.backoff()
+
+	if e.rto != 3 {
+		t.Fatalf("RTO above maximum: %f", e.rto)
+	}
+}
+
+func TestRTOKarn(t *testing.T) {
+	var e rtoEstimator
+	e.init(Config{}, 0)
+	e.sample(0.1, 0)
+	e.backoff()
+
+	rto := e.rto
+
+	// Packets sent before the backoff are ambiguous.
+	e.sample(0.1, 0)
+
+	if e.rto != rto {
+		t.Fatalf("Ambiguous sample was used: RTO %f, want %f", e.rto, rto)
+	}
+
+	e.sample(0.1, 1)
+
+	if e.rto >= rto {
+		t.Fatalf("Backed off RTO was not reset: %f", e.rto)
+	}
+}
+
+func TestRTOLoss(t *testing.T) {
+	r := NewReliability()
+	r.rto.init(Config{InitialRTO: time.Millisecond * 100}, 0)
+
+	r.packetSent(10)
+
+	if lost := r.update(0.05, nil); len(lost) != 0 {
+		t.Fatalf("Packet lost too early")
+	}
+
+	if lost := r.update(0.06, nil); len(lost) != 1 || lost[0] != 0 {
+		t.Fatalf("Packet was not lost: %v", lost)
+	}
+
+	if st := r.Stats(); st.LostPackets != 1 || !near(st.RTO, 0.2) {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	tests := []struct {
+		cfg Config
+		ok  bool
+	}{
+		{Config{}, true},
+		{Config{MinRTO: time.Millisecond}, true},
+		{Config{MinRTO: -1}, false},
+		{Config{MinRTO: time.Second * 2}, false},
+		{Config{MaxRTO: time.Millisecond * 500}, false},
+		{Config{MinRTO: time.Millisecond, InitialRTO: time.Millisecond, MaxRTO: time.Millisecond}, true},
+		{Config{AckDelay: time.Second, AckEvery: 2}, true},
+		{Config{AckDelay: -1}, false},
+		{Config{AckEvery: -1}, false},
+	}
+
+	for i, ct := range tests {
+		_, err := ct.cfg.normalize()
+
+		if (err == nil) != ct.ok {
+			t.Fatalf("Config %d: Unexpected error %v", i, err)
+		}
+	}
+}
+
+func near(a, b float32) bool {
+	d := a - b
+	return d < 1e-5 && d > -1e-5
+}
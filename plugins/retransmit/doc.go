@@ -0,0 +1,32 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+/*
+The retransmit plugin resends lost messages on top of the reliability
+plugin. The reliability plugin only tells the host which packets were
+ACK'ed or lost. This plugin acts on that information.
+
+Messages sent through Plugin.SendReliable are reliable. The plugin keeps
+a copy of each one, until the peer ACKs it. When the reliability plugin
+reports it lost, the message is resent after a short backoff, which
+doubles with every attempt. Once Config.Retries resends have been lost as
+well, the plugin gives up and hands the message to the host's give-up
+handler. Messages sent through the connection directly, are not kept.
+
+Messages are also given up on when the connection closes, and when a
+peer is evicted after being idle (see xudp.Connection.SetPeerTimeout).
+The reliability plugin forgets the sequence numbers at those moments, so
+the messages can no longer be ACK'ed.
+
+The plugin adds nothing to the packets. It learns the sequence number of
+each message, and whether it arrived, through its Sent, Acked and Lost
+methods. These are passed to the reliability plugin as its handlers.
+Hosts which need these events themselves, can wrap them in handlers of
+their own.
+
+Resent messages are new packets, with new sequence numbers. They may
+arrive out of order, or more than once if an ACK was lost rather than the
+message itself. Hosts which need each message exactly once and in order,
+must take care of that themselves.
+*/
+package retransmit
@@ -0,0 +1,49 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package retransmit
+
+import (
+	"net"
+	"net/netip"
+)
+
+// peer holds the messages to a single peer, which wait for their ACK.
+// Its fields are guarded by the plugin's mutex.
+type peer struct {
+	inflight map[uint32]*message // Messages by sequence number.
+}
+
+// abandon marks the in-flight messages of pr as given up on, and removes
+// them. They are appended to list, which is returned.
+func (pr *peer) abandon(list []*message) []*message {
+	for _, m := range pr.inflight {
+		m.done = true
+		list = append(list, m)
+	}
+
+	clear(pr.inflight)
+	return list
+}
+
+// peerKey identifies a peer the same way the connection does. UDP
+// addresses are kept as netip.AddrPort values, so they can be used without
+// allocating. Other addresses are stored in their string form.
+type peerKey struct {
+	ap  netip.AddrPort
+	str string
+}
+
+// keyOf returns the key for the given address.
+func keyOf(addr net.Addr) peerKey {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		ap := ua.AddrPort()
+		return peerKey{ap: netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())}
+	}
+
+	if addr == nil {
+		return peerKey{}
+	}
+
+	return peerKey{str: addr.String()}
+}
@@ -0,0 +1,400 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package retransmit
+
+import (
+	"bytes"
+	"errors"
+	"github.com/jteeuwen/xudp"
+	"net"
+	"sync"
+	"time"
+)
+
+// Defaults for the fields of Config.
+const (
+	DefaultRetries = 5
+	DefaultBackoff = 10 * time.Millisecond
+)
+
+var ErrConfig = errors.New("Retries and Backoff must not be negative.")
+
+var (
+	_ xudp.PeerPlugin = (*Plugin)(nil)
+	_ xudp.Ticker     = (*Plugin)(nil)
+)
+
+// A Sender sends a payload to the given address. *xudp.Connection is
+// the obvious candidate.
+type Sender interface {
+	Send(addr net.Addr, payload []byte) error
+}
+
+// GiveUpFunc receives a message which could not be delivered.
+type GiveUpFunc func(addr net.Addr, payload []byte)
+
+// Config holds the settings for resending lost messages. Fields which are
+// left zero, select their default value.
+type Config struct {
+	Retries int           // Number of times a lost message is resent.
+	Backoff time.Duration // Delay before the first resend. It doubles for each subsequent one.
+}
+
+// normalize fills in the defaults and validates the result.
+func (c Config) normalize() (Config, error) {
+	if c.Retries == 0 {
+		c.Retries = DefaultRetries
+	}
+
+	if c.Backoff == 0 {
+		c.Backoff = DefaultBackoff
+	}
+
+	if c.Retries < 0 || c.Backoff < 0 {
+		return c, ErrConfig
+	}
+
+	return c, nil
+}
+
+// message is a reliable message which has not been ACK'ed yet.
+type message struct {
+	addr    net.Addr      // Address passed to SendReliable.
+	payload []byte        // Copy of the payload.
+	tries   int           // Number of times the message was resent.
+	wait    time.Duration // Time left until the next resend.
+	done    bool          // Set when Close or ClosePeer gives up on the message.
+}
+
+// Plugin resends the reliable messages which the reliability plugin
+// reports lost.
+type Plugin struct {
+	sender   Sender
+	gaveUp   GiveUpFunc
+	mu       sync.Mutex // Guards the fields below.
+	config   Config
+	outgoing []*message        // Messages being sent, whose sequence number is not known yet.
+	peers    map[peerKey]*peer // Messages waiting for their ACK, by peer.
+	resend   []*message        // Messages waiting to be resent.
+	ticked   time.Time         // Time of the previous tick.
+}
+
+// New creates a new retransmit plugin, which resends lost messages
+// through s. The optional gaveUp handler receives the messages which are
+// still lost after all retries, or pending when the connection closes or
+// the peer is evicted.
+//
+// The plugin learns about the fate of each packet through its Sent, Acked
+// and Lost methods. These must be passed to the reliability plugin of the
+// same connection:
+//
+//	rt := retransmit.New(conn, gaveUp)
+//	conn.Register(reliability.New(rt.Sent, recv, rt.Acked, rt.Lost, 30))
+//	conn.Register(rt)
+func New(s Sender, gaveUp GiveUpFunc) *Plugin {
+	p := new(Plugin)
+	p.sender = s
+	p.gaveUp = gaveUp
+	p.config, _ = Config{}.normalize()
+	p.peers = make(map[peerKey]*peer)
+	return p
+}
+
+// PayloadSize returns 0. The plugin adds nothing to the packets.
+func (p *Plugin) PayloadSize() int { return 0 }
+
+// Open and Close give up on all pending messages. The reliability plugin
+// starts new sequence numbers at those moments, so they can no longer be
+// ACK'ed.
+func (p *Plugin) Open(port int) error {
+	p.reset()
+	return nil
+}
+
+func (p *Plugin) Close() error {
+	p.reset()
+	return nil
+}
+
+func (p *Plugin) reset() {
+	p.mu.Lock()
+
+	list := make([]*message, 0, len(p.outgoing)+len(p.resend))
+	list = append(list, p.outgoing...)
+	list = append(list, p.resend...)
+
+	for _, m := range list {
+		m.done = true
+	}
+
+	for _, pr := range p.peers {
+		list = pr.abandon(list)
+	}
+
+	p.outgoing = nil
+	p.resend = nil
+	clear(p.peers)
+	p.ticked = time.Time{}
+	p.mu.Unlock()
+
+	p.giveUp(list)
+}
+
+// NewPeer returns the state which holds the in-flight messages of a peer.
+func (p *Plugin) NewPeer(addr net.Addr) interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.peer(addr)
+}
+
+// peer returns the state of the peer with the given address. It is created
+// if the connection has not asked for it yet. This happens when the plugin
+// is registered in front of the reliability plugin, which reports sent
+// packets before the connection reaches this plugin.
+func (p *Plugin) peer(addr net.Addr) *peer {
+	key := keyOf(addr)
+	pr, ok := p.peers[key]
+
+	if !ok {
+		pr = &peer{inflight: make(map[uint32]*message)}
+		p.peers[key] = pr
+	}
+
+	return pr
+}
+
+// ClosePeer gives up on the in-flight messages of a peer which has been
+// evicted. The reliability plugin forgets the peer at the same moment, so
+// these messages can no longer be ACK'ed or reported lost. Messages which
+// wait to be resent, are kept. They start over with a new sequence number.
+func (p *Plugin) ClosePeer(addr net.Addr, state interface{}) {
+	pr := state.(*peer)
+
+	p.mu.Lock()
+
+	if key := keyOf(addr); p.peers[key] == pr {
+		delete(p.peers, key)
+	}
+
+	list := pr.abandon(nil)
+	p.mu.Unlock()
+	p.giveUp(list)
+}
+
+// Send and Recv are not called. SendPeer and RecvPeer do nothing. The
+// plugin adds nothing to the packets.
+func (p *Plugin) Send(net.Addr, []byte, int) error { return nil }
+func (p *Plugin) Recv(net.Addr, []byte, int) error { return nil }
+
+func (p *Plugin) SendPeer(interface{}, net.Addr, []byte, int) (int, error) { return 0, nil }
+func (p *Plugin) RecvPeer(interface{}, net.Addr, []byte, int) error        { return nil }
+
+// giveUp hands the given messages to the give-up handler.
+func (p *Plugin) giveUp(list []*message) {
+	if p.gaveUp == nil {
+		return
+	}
+
+	for _, m := range list {
+		p.gaveUp(m.addr, m.payload)
+	}
+}
+
+// SetConfig changes the retry settings. Returns ErrConfig if they are not
+// valid. They apply to messages which are lost after the call.
+func (p *Plugin) SetConfig(cfg Config) error {
+	cfg, err := cfg.normalize()
+
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.config = cfg
+	p.mu.Unlock()
+	return nil
+}
+
+// Pending returns the number of messages which have been neither ACK'ed,
+// nor given up on.
+func (p *Plugin) Pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.outgoing) + len(p.resend)
+
+	for _, pr := range p.peers {
+		n += len(pr.inflight)
+	}
+
+	return n
+}
+
+// SendReliable sends the given payload and keeps a copy of it, until the
+// peer has ACK'ed it. Lost messages are resent. Payloads sent through the
+// Sender directly, are not.
+func (p *Plugin) SendReliable(addr net.Addr, payload []byte) error {
+	m := &message{
+		addr:    addr,
+		payload: append([]byte(nil), payload...),
+	}
+
+	return p.send(m)
+}
+
+// send hands m to the sender. The call to Sent which results from it,
+// moves the message to the in-flight set.
+func (p *Plugin) send(m *message) error {
+	p.mu.Lock()
+	p.outgoing = append(p.outgoing, m)
+	p.mu.Unlock()
+
+	err := p.sender.Send(m.addr, m.payload)
+
+	p.mu.Lock()
+	p.remove(m)
+	p.mu.Unlock()
+	return err
+}
+
+// remove takes m from the outgoing list, if it is still there.
+func (p *Plugin) remove(m *message) {
+	for i, om := range p.outgoing {
+		if om == m {
+			p.outgoing = append(p.outgoing[:i], p.outgoing[i+1:]...)
+			return
+		}
+	}
+}
+
+// Sent is the reliability plugin's sent handler. It pairs the sequence
+// number with an outgoing reliable message. Messages are told apart by
+// address and contents. Identical messages to the same peer may swap
+// sequence numbers, but that does not change what the peer receives.
+//
+// Plugins which transform the payload, must therefore be registered
+// outside of the reliability plugin.
+func (p *Plugin) Sent(sequence uint32, addr net.Addr, payload []byte) {
+	key := keyOf(addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, m := range p.outgoing {
+		if m.addr != nil && keyOf(m.addr) != key {
+			continue
+		}
+
+		if bytes.Equal(m.payload, payload) {
+			p.remove(m)
+			p.peer(addr).inflight[sequence] = m
+			return
+		}
+	}
+}
+
+// Acked is the reliability plugin's ACK handler. It releases the message
+// with the given sequence number.
+func (p *Plugin) Acked(sequence uint32, addr net.Addr) {
+	p.mu.Lock()
+
+	if pr, ok := p.peers[keyOf(addr)]; ok {
+		delete(pr.inflight, sequence)
+	}
+
+	p.mu.Unlock()
+}
+
+// Lost is the reliability plugin's loss handler. It schedules the message
+// with the given sequence number to be resent, or gives up on it once all
+// retries have been used.
+func (p *Plugin) Lost(sequence uint32, addr net.Addr) {
+	var m *message
+	var ok bool
+
+	p.mu.Lock()
+
+	if pr, found := p.peers[keyOf(addr)]; found {
+		m, ok = pr.inflight[sequence]
+		delete(pr.inflight, sequence)
+	}
+
+	if ok && p.retry(m) {
+		ok = false
+	}
+
+	p.mu.Unlock()
+
+	if ok && p.gaveUp != nil {
+		p.gaveUp(addr, m.payload)
+	}
+}
+
+// retry schedules m to be resent. Returns false if it has run out of
+// retries.
+func (p *Plugin) retry(m *message) bool {
+	if m.tries >= p.config.Retries {
+		return false
+	}
+
+	m.wait = p.config.Backoff << m.tries
+	m.tries++
+	p.resend = append(p.resend, m)
+	return true
+}
+
+// TickInterval returns the resolution of the backoff.
+func (p *Plugin) TickInterval() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return max(p.config.Backoff/2, time.Millisecond)
+}
+
+// Tick resends the messages whose backoff has elapsed.
+func (p *Plugin) Tick(now time.Time) {
+	var due []*message
+
+	interval := p.TickInterval()
+
+	p.mu.Lock()
+
+	delta := interval
+
+	if !p.ticked.IsZero() {
+		delta = now.Sub(p.ticked)
+	}
+
+	p.ticked = now
+	list := p.resend[:0]
+
+	for _, m := range p.resend {
+		m.wait -= delta
+
+		if m.wait > 0 {
+			list = append(list, m)
+		} else {
+			due = append(due, m)
+		}
+	}
+
+	clear(p.resend[len(list):])
+	p.resend = list
+	p.mu.Unlock()
+
+	for _, m := range due {
+		if p.send(m) == nil {
+			continue
+		}
+
+		// Messages which were given up on while being sent, are left
+		// alone.
+		p.mu.Lock()
+		ok := m.done || p.retry(m)
+		p.mu.Unlock()
+
+		if !ok && p.gaveUp != nil {
+			p.gaveUp(m.addr, m.payload)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package retransmit
+
+import (
+	"github.com/jteeuwen/xudp"
+	"github.com/jteeuwen/xudp/plugins/reliability"
+	"net"
+	"testing"
+	"time"
+)
+
+var Payload = []byte("Hello, world!")
+
+func TestBackoff(t *testing.T) {
+	var given [][]byte
+
+	s := &fakeSender{}
+	p := New(s, func(addr net.Addr, payload []byte) { given = append(given, payload) })
+	s.p = p
+
+	if p.SetConfig(Config{Retries: -1}) != ErrConfig {
+		t.Fatalf("Invalid config was accepted")
+	}
+
+	p.SetConfig(Config{Retries: 2, Backoff: time.Millisecond * 10})
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10031}
+	p.SendReliable(addr, Payload)
+
+	now := time.Now()
+	p.Tick(now)
+
+	// Resends wait 10ms, then 20ms.
+	for i, wait := range []int{10, 20} {
+		p.Lost(s.sequence-1, addr)
+
+		for ms := 5; ms < wait; ms += 5 {
+			now = now.Add(time.Millisecond * 5)
+			p.Tick(now)
+
+			if s.sequence != uint32(i+1) {
+				t.Fatalf("Resend %d happened after %dms", i, ms)
+			}
+		}
+
+		now = now.Add(time.Millisecond * 5)
+		p.Tick(now)
+
+		if s.sequence != uint32(i+2) {
+			t.Fatalf("Resend %d did not happen after %dms", i, wait)
+		}
+	}
+
+	p.Lost(s.sequence-1, addr)
+
+	if len(given) != 1 || string(given[0]) != string(Payload) || p.Pending() != 0 {
+		t.Fatalf("Message was not given up on: %q, %d pending", given, p.Pending())
+	}
+}
+
+func TestAcked(t *testing.T) {
+	s := &fakeSender{}
+	p := New(s, nil)
+	s.p = p
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10031}
+
+	p.SendReliable(addr, Payload)
+	p.SendReliable(addr, []byte("Other"))
+
+	// Packets sent outside of SendReliable are not kept.
+	p.Sent(2, addr, Payload)
+	p.Acked(0, addr)
+
+	if p.Pending() != 1 {
+		t.Fatalf("Want 1 pending message, have %d", p.Pending())
+	}
+
+	// Neither are lost packets which were never reliable.
+	p.Lost(2, addr)
+	p.Acked(1, addr)
+
+	if p.Pending() != 0 {
+		t.Fatalf("Want 0 pending messages, have %d", p.Pending())
+	}
+}
+
+func TestClose(t *testing.T) {
+	var given []string
+
+	s := &fakeSender{}
+	p := New(s, func(addr net.Addr, payload []byte) { given = append(given, string(payload)) })
+	s.p = p
+
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10031}
+	b := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10032}
+
+	p.SendReliable(a, []byte("a0"))
+	p.SendReliable(a, []byte("a1"))
+	p.SendReliable(b, []byte("b0"))
+	p.Lost(2, b)
+
+	// Evicting a only gives up on its in-flight messages.
+	p.ClosePeer(a, p.NewPeer(a))
+
+	if len(given) != 2 || p.Pending() != 1 {
+		t.Fatalf("Want 2 messages given up on and 1 pending; have %q, %d", given, p.Pending())
+	}
+
+	p.Close()
+
+	if len(given) != 3 || given[2] != "b0" || p.Pending() != 0 {
+		t.Fatalf("Want 3 messages given up on and none pending; have %q, %d", given, p.Pending())
+	}
+
+	p.Tick(time.Now().Add(time.Second))
+
+	if s.sequence != 3 {
+		t.Fatalf("Message was resent after Close")
+	}
+}
+
+func TestPeerState(t *testing.T) {
+	s := &fakeSender{}
+	p := New(s, nil)
+	s.p = p
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10031}
+	state := p.NewPeer(addr)
+
+	p.SendReliable(addr, Payload)
+
+	if n := len(state.(*peer).inflight); n != 1 {
+		t.Fatalf("Want 1 message in the peer state, have %d", n)
+	}
+
+	// Looking up the peer of an ACK does not allocate.
+	allocs := testing.AllocsPerRun(100, func() {
+		p.Acked(42, addr)
+	})
+
+	if allocs != 0 {
+		t.Fatalf("Acked allocates %v times", allocs)
+	}
+
+	// A new peer at the same address has nothing in flight. Closing the
+	// old one, does not forget the new one.
+	p.ClosePeer(addr, state)
+	fresh := p.NewPeer(addr)
+	p.SendReliable(addr, Payload)
+	p.ClosePeer(addr, state)
+
+	if fresh == state || p.Pending() != 1 {
+		t.Fatalf("Want 1 pending message, have %d", p.Pending())
+	}
+}
+
+func TestConn(t *testing.T) {
+	ca, pa := initConn(t, 10032)
+	cb, _ := initConn(t, 10033)
+
+	defer ca.Close()
+	defer cb.Close()
+
+	go func() {
+		for {
+			if _, _, err := ca.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10033}
+
+	for i := 0; i < 3; i++ {
+		if err := pa.SendReliable(addr, Payload); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, payload, _ := cb.Recv(); string(payload) != string(Payload) {
+			t.Fatalf("Payload mismatch: %q", payload)
+		}
+	}
+
+	// The standalone ACKs release all messages.
+	deadline := time.Now().Add(time.Second)
+
+	for pa.Pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages were not released", pa.Pending())
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	given := make(chan []byte, 1)
+
+	c := xudp.New(1400)
+	p := New(c, func(addr net.Addr, payload []byte) { given <- payload })
+	p.SetConfig(Config{Retries: 2, Backoff: time.Millisecond})
+
+	rp := reliability.New(p.Sent, nil, p.Acked, p.Lost, 100).(*reliability.Plugin)
+	rp.SetConfig(reliability.Config{MinRTO: time.Millisecond * 10, InitialRTO: time.Millisecond * 20})
+
+	c.Register(rp)
+	c.Register(p)
+
+	err := c.Open(10034)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c.Close()
+
+	// Nobody is listening on this port.
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10035}
+	p.SendReliable(addr, Payload)
+
+	select {
+	case payload := <-given:
+		if string(payload) != string(Payload) {
+			t.Fatalf("Payload mismatch: %q", payload)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Message was not given up on")
+	}
+
+	st := rp.Peers()[0].Stats()
+
+	if st.SentPackets != 3 || p.Pending() != 0 {
+		t.Fatalf("Want 3 packets sent and none pending; have %d, %d",
+			st.SentPackets, p.Pending())
+	}
+}
+
+func initConn(t *testing.T, port int) (*xudp.Connection, *Plugin) {
+	c := xudp.New(1400)
+	p := New(c, nil)
+
+	c.Register(reliability.New(p.Sent, nil, p.Acked, p.Lost, 60))
+	c.Register(p)
+
+	err := c.Open(port)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, p
+}
+
+// fakeSender numbers the payloads it is given, like the reliability plugin.
+type fakeSender struct {
+	p        *Plugin
+	sequence uint32
+}
+
+func (s *fakeSender) Send(addr net.Addr, payload []byte) error {
+	s.p.Sent(s.sequence, addr, payload)
+	s.sequence++
+	return nil
+}
@@ -0,0 +1,152 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import (
+	"sync"
+	"time"
+)
+
+// scheduler ticks the registered Tickers and evicts idle peers, while
+// a connection is open. It has no goroutine of its own. Instead, it runs
+// on timers set through the connection's Clock.
+type scheduler struct {
+	conn    *Connection
+	sock    *socket
+	clock   Clock
+	run     sync.Mutex // Serializes runs, so ticks never overlap.
+	mu      sync.Mutex // Guards the fields below.
+	timer   Timer
+	due     map[Ticker]time.Time // Time of the next tick for each ticker.
+	stopped bool
+}
+
+func newScheduler(c *Connection, s *socket, clk Clock) *scheduler {
+	return &scheduler{
+		conn:  c,
+		sock:  s,
+		clock: clk,
+		due:   make(map[Ticker]time.Time),
+	}
+}
+
+// kick runs the scheduler as soon as possible. This picks up changes to
+// the registered plugins and the peer timeout.
+func (sc *scheduler) kick() { sc.schedule(0) }
+
+// stop cancels all future runs.
+func (sc *scheduler) stop() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.stopped = true
+
+	if sc.timer != nil {
+		sc.timer.Stop()
+		sc.timer = nil
+	}
+}
+
+// schedule sets the timer for the next run, replacing the current one.
+func (sc *scheduler) schedule(d time.Duration) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.stopped {
+		return
+	}
+
+	if sc.timer != nil {
+		sc.timer.Stop()
+	}
+
+	sc.timer = sc.clock.AfterFunc(d, sc.tick)
+}
+
+// tick calls Tick on every ticker which is due, evicts idle peers and
+// schedules the next run.
+func (sc *scheduler) tick() {
+	sc.run.Lock()
+	defer sc.run.Unlock()
+
+	pl, ok := sc.conn.acquire(sc.sock)
+
+	if !ok {
+		return
+	}
+
+	now := sc.clock.Now()
+	next := sc.conn.peers.evict(now)
+
+	for _, t := range sc.dueTickers(pl, now) {
+		t.Tick(now)
+	}
+
+	sc.sock.busy.Done()
+
+	sc.mu.Lock()
+	for _, due := range sc.due {
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+	sc.mu.Unlock()
+
+	if !next.IsZero() {
+		sc.schedule(next.Sub(now))
+	}
+}
+
+// dueTickers returns the tickers in pl which are due at the given time and
+// advances their due times. Tickers are first due one interval after they
+// are seen. Tickers which are no longer registered are forgotten.
+func (sc *scheduler) dueTickers(pl PluginList, now time.Time) []Ticker {
+	var list []Ticker
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for t := range sc.due {
+		if !pl.Contains(t) {
+			delete(sc.due, t)
+		}
+	}
+
+	for _, plg := range pl {
+		t, ok := plg.(Ticker)
+
+		if !ok {
+			continue
+		}
+
+		interval := t.TickInterval()
+
+		if interval <= 0 {
+			delete(sc.due, t)
+			continue
+		}
+
+		due, ok := sc.due[t]
+
+		if !ok {
+			sc.due[t] = now.Add(interval)
+			continue
+		}
+
+		if now.Before(due) {
+			continue
+		}
+
+		list = append(list, t)
+		due = due.Add(interval)
+
+		if !due.After(now) {
+			due = now.Add(interval) // Skip the ticks we missed.
+		}
+
+		sc.due[t] = due
+	}
+
+	return list
+}
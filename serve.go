@@ -0,0 +1,220 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+)
+
+// A Handler is called by Serve for every received payload.
+//
+// The payload buffer is reused once the call returns. Handlers must
+// copy any data they wish to retain.
+type Handler func(addr net.Addr, payload []byte)
+
+// SetReaders sets the number of goroutines Serve uses to receive and
+// process packets. Values below 1 select the default, which is the
+// value of runtime.GOMAXPROCS. It takes effect on the next call to Serve.
+func (c *Connection) SetReaders(n int) {
+	c.mu.Lock()
+	c.readers = n
+	c.mu.Unlock()
+}
+
+// Serve receives packets and passes their payloads to the given handler.
+// It blocks until the context ends, the connection is closed or reading
+// from the socket fails. Handler calls which are in progress at that
+// time are allowed to finish before Serve returns.
+//
+// Packets are received and run through the plugins by multiple
+// goroutines at once. See SetReaders. The handler is therefore called
+// concurrently, but never for two packets from the same peer at the same
+// time. Payloads from a single peer are handed to the handler in the
+// order in which they were received. Packets which are rejected by a
+// plugin or carry no payload, are dropped.
+//
+// Serve returns the context's error if the context ended, or
+// ErrConnectionectionClosed if the connection was closed.
+func (c *Connection) Serve(ctx context.Context, h Handler) error {
+	s := c.socket()
+
+	if s == nil {
+		return ErrConnectionectionClosed
+	}
+
+	// The readers are interrupted when the context ends, or when one of
+	// them fails. Other calls which receive from the connection, are not.
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stop, err := s.rd.watch(rctx)
+
+	if err != nil {
+		return err
+	}
+
+	sv := server{
+		conn:   c,
+		sock:   s,
+		h:      h,
+		cancel: rctx.Done(),
+		peers:  make(map[peerKey]*peerTurn),
+	}
+
+	n := c.readerCount()
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		go func() { errs <- sv.run() }()
+	}
+
+	err = <-errs
+	cancel()
+
+	for i := 1; i < n; i++ {
+		<-errs
+	}
+
+	stop()
+	return contextError(ctx, err)
+}
+
+// readerCount returns the number of goroutines Serve should use.
+func (c *Connection) readerCount() int {
+	c.mu.RLock()
+	n := c.readers
+	c.mu.RUnlock()
+
+	if n < 1 {
+		n = runtime.GOMAXPROCS(0)
+	}
+
+	return n
+}
+
+// server holds the state for a single call to Serve.
+type server struct {
+	conn   *Connection
+	sock   *socket
+	h      Handler
+	cancel <-chan struct{} // Closed when the readers must stop.
+	read   sync.Mutex      // Serializes socket reads, so tickets match arrival order.
+	mu     sync.Mutex      // Guards peers.
+	peers  map[peerKey]*peerTurn
+}
+
+// peerTurn hands out turns for calling the handler with packets from
+// a single peer. Packets are served in the order of their tickets.
+type peerTurn struct {
+	cond    sync.Cond
+	next    uint64 // Ticket for the next packet to arrive.
+	serving uint64 // Ticket of the packet which may call the handler.
+}
+
+// run receives packets until reading from the socket fails.
+func (sv *server) run() error {
+	buf := sv.conn.buffers.Get().(*[]byte)
+	defer sv.conn.buffers.Put(buf)
+
+	for {
+		sv.read.Lock()
+		size, addr, err := sv.conn.readFrom(sv.sock, *buf, sv.cancel)
+
+		if err != nil {
+			sv.read.Unlock()
+			return closedError(err)
+		}
+
+		turn, ticket := sv.ticket(addr)
+		sv.read.Unlock()
+
+		payload, err := sv.conn.process(sv.sock, addr, (*buf)[:size], nil)
+
+		sv.wait(turn, ticket)
+
+		if err == nil && len(payload) > 0 {
+			sv.h(addr, payload)
+		}
+
+		sv.done(addr, turn)
+
+		if err == ErrConnectionectionClosed {
+			return err
+		}
+	}
+}
+
+// ticket returns the turn for the given peer, along with the ticket for
+// a newly received packet.
+func (sv *server) ticket(addr net.Addr) (*peerTurn, uint64) {
+	key := keyOf(addr)
+
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	turn, ok := sv.peers[key]
+
+	if !ok {
+		turn = new(peerTurn)
+		turn.cond.L = &sv.mu
+		sv.peers[key] = turn
+	}
+
+	ticket := turn.next
+	turn.next++
+	return turn, ticket
+}
+
+// wait blocks until it is the given ticket's turn.
+func (sv *server) wait(turn *peerTurn, ticket uint64) {
+	sv.mu.Lock()
+
+	for turn.serving != ticket {
+		turn.cond.Wait()
+	}
+
+	sv.mu.Unlock()
+}
+
+// done passes the turn to the next packet from the same peer. The peer
+// is forgotten once it has no more packets waiting.
+func (sv *server) done(addr net.Addr, turn *peerTurn) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	turn.serving++
+
+	if turn.serving == turn.next {
+		delete(sv.peers, keyOf(addr))
+		return
+	}
+
+	turn.cond.Broadcast()
+}
+
+// peerKey identifies a peer. UDP addresses are stored as an AddrPort,
+// so they can be used without allocating. Other addresses are stored
+// in their string form.
+type peerKey struct {
+	ap  netip.AddrPort
+	str string
+}
+
+// keyOf returns the key for the given address.
+func keyOf(addr net.Addr) peerKey {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		ap := ua.AddrPort()
+		return peerKey{ap: netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())}
+	}
+
+	if addr == nil {
+		return peerKey{}
+	}
+
+	return peerKey{str: addr.String()}
+}
@@ -0,0 +1,68 @@
+// This file is subject to a 1-clause BSD license.
+// Its contents can be found in the enclosed LICENSE file.
+
+package xudp
+
+// A Stage determines where a plugin's data ends up in a packet, relative
+// to the data of other plugins.
+//
+// Plugins are layered like an onion. The outermost layer belongs to the
+// earliest stage. It is processed first when a packet is received and
+// last when a packet is sent. Within a stage, plugins registered earlier
+// are further out than those registered after them.
+type Stage int
+
+// Known stages, from the outermost to the innermost.
+const (
+	// Cheap checks which discard unwanted packets as early as possible.
+	// For example: the protocol plugin.
+	StageFilter Stage = iota
+
+	// Authentication and encryption. Plugins at this stage protect the
+	// data of all plugins in the transport stage.
+	StageSecurity
+
+	// Peer identification, sequencing, acknowledgement and anything else
+	// which deals with the payload. This is the default stage.
+	StageTransport
+
+	// Plugins which hand payloads to the host themselves, such as the
+	// ordered plugin. They see each packet after all transport plugins
+	// have processed it.
+	StageDelivery
+
+	stageCount
+)
+
+// A Stager is a Plugin which declares the stage it belongs to.
+// Plugins which do not implement it belong to StageTransport.
+type Stager interface {
+	Stage() Stage
+}
+
+// StageOf returns the stage the given plugin belongs to.
+func StageOf(p Plugin) Stage {
+	if s, ok := p.(Stager); ok {
+		return s.Stage()
+	}
+
+	return StageTransport
+}
+
+// Valid returns true if s is one of the known stages.
+func (s Stage) Valid() bool { return s >= StageFilter && s < stageCount }
+
+func (s Stage) String() string {
+	switch s {
+	case StageFilter:
+		return "filter"
+	case StageSecurity:
+		return "security"
+	case StageTransport:
+		return "transport"
+	case StageDelivery:
+		return "delivery"
+	}
+
+	return "invalid"
+}
@@ -111,9 +111,9 @@ func loop(c *xudp.Connection, address net.Addr) {
 	// Statistics printing ticker.
 	statTick := time.NewTicker(time.Second)
 
-	// Channel which accepts incoming messages.
-	// This allows us to do non-blocking reads.
-	recv := readLoop(c)
+	// Incoming messages. We only care about the sender's address,
+	// so newer messages may replace older ones if we fall behind.
+	recv := c.Incoming(16, xudp.DropOldest)
 
 	// If we have an address, we are the 'client' and should
 	// initiate the echo loop.
@@ -126,81 +126,55 @@ func loop(c *xudp.Connection, address net.Addr) {
 		case <-statTick.C:
 			stat(&avgSent, &avgAcked)
 
-		default:
-			// Receive next message.
-			address, ok := <-recv
-
+		case packet, ok := <-recv:
 			if !ok {
-				break
-			}
-
-			// Send a random payload back.
-			err := c.Send(address, make([]byte, rand.Int31n(int32(c.PayloadSize()))))
-
-			if err != nil {
 				return
 			}
-		}
-	}
-}
-
-// readLoop reads data from the connection and yields it through the
-// returned channel. This allows us to make the read a non-blocking operation.
-//
-// In this particular program, we do not care about the actual payload.
-// Just the sender's address.
-func readLoop(c *xudp.Connection) <-chan net.Addr {
-	ch := make(chan net.Addr)
 
-	go func() {
-		defer close(ch)
+			address := packet.Addr
+			packet.Release()
 
-		for {
-			address, _, err := c.Recv()
+			// Send a random payload back.
+			err := c.Send(address, make([]byte, 1+rand.Int31n(int32(c.PayloadSize()))))
 
 			if err != nil {
 				return
 			}
-
-			ch <- address
 		}
-	}()
-
-	return ch
+	}
 }
 
 // stat prints connection statistics.
+// We only ever talk to a single peer.
 func stat(sent, acked *[]float32) {
-	rt := plugin.RTT
-	sp := plugin.SentPackets
-	ap := plugin.AckedPackets
-	lp := plugin.LostPackets
+	peers := plugin.Peers()
+
+	if len(peers) == 0 {
+		return
+	}
+
+	st := peers[0].Stats()
 
 	// Update list for average sent bandwidth
 	if len(*sent) < cap(*sent) {
-		*sent = append(*sent, plugin.SentBandwidth)
+		*sent = append(*sent, st.SentBandwidth)
 	} else {
 		copy((*sent)[1:], *sent)
-		(*sent)[0] = plugin.SentBandwidth
+		(*sent)[0] = st.SentBandwidth
 	}
 
 	// Update list for average ACK'ed bandwidth
 	if len(*acked) < cap(*acked) {
-		*acked = append(*acked, plugin.AckedBandwidth)
+		*acked = append(*acked, st.AckedBandwidth)
 	} else {
 		copy((*acked)[1:], *acked)
-		(*acked)[0] = plugin.AckedBandwidth
-	}
-
-	var lr float32
-
-	if sp > 0 {
-		lr = float32(lp) / float32(sp) * 100.0
+		(*acked)[0] = st.AckedBandwidth
 	}
 
 	fmt.Printf(
 		"rtt %.1fms, sent %d (%.1fkbps), acked %d (%.1fkbps), lost %d (%.1f%%)\n",
-		rt*1000.0, sp, avg(*sent), ap, avg(*acked), lp, lr)
+		st.RTT*1000.0, st.SentPackets, avg(*sent), st.AckedPackets, avg(*acked),
+		st.LostPackets, st.LossRate()*100.0)
 }
 
 // avg returns the average of all values in the given list.
@@ -97,14 +97,9 @@ func loop(c *OrderedConnection, addr net.Addr) {
 			}
 
 			if addr == nil {
-				// Server only returns empty packets.
-				// These are necessary because they contain our ACK data.
+				// The server only logs what it receives. The reliability
+				// plugin sends our ACKs by itself.
 				log.Printf("recv: %s", data.Payload)
-				err = c.Send(data.Addr, nil)
-			}
-
-			if err != nil {
-				return
 			}
 		}
 	}
@@ -4,8 +4,12 @@
 package main
 
 import (
+	"context"
 	"github.com/jteeuwen/xudp"
+	"github.com/jteeuwen/xudp/plugins/ordered"
 	"github.com/jteeuwen/xudp/plugins/reliability"
+	"github.com/jteeuwen/xudp/plugins/retransmit"
+	"log"
 	"net"
 )
 
@@ -14,39 +18,46 @@ type Data struct {
 	Payload []byte
 }
 
-// An OrderedConnection guarantees in-order reception of data
-// and resends lost packets.
+// An OrderedConnection delivers data in the order it was sent and
+// resends lost packets. A resent packet gets a new number, so it is
+// delivered in its new place. Only packets which are not lost, are
+// guaranteed to be delivered in order.
 type OrderedConnection struct {
 	*xudp.Connection
-	recvCache map[uint32]*Data
-	sendCache map[uint32]*Data
-	Incoming  chan *Data
-	sequence  uint32
+	resend   *retransmit.Plugin
+	Incoming chan *Data
 }
 
 // NewOrderedConnection creates a new ordered connection.
 func NewOrderedConnection(mtu uint32) *OrderedConnection {
 	c := new(OrderedConnection)
 	c.Connection = xudp.New(mtu)
-	c.recvCache = make(map[uint32]*Data)
-	c.sendCache = make(map[uint32]*Data)
-	c.Incoming = make(chan *Data)
+	c.Incoming = make(chan *Data, 64)
+	c.resend = retransmit.New(c.Connection, func(addr net.Addr, data []byte) {
+		log.Printf("gave up on: %s", data)
+	})
 
 	c.Register(reliability.New(
-		func(seq uint32, addr net.Addr, data []byte) {
-			c.sent(seq, addr, data)
+		c.resend.Sent,
+		nil,
+		c.resend.Acked,
+		func(seq uint32, addr net.Addr) {
+			println("lost", seq)
+			c.resend.Lost(seq, addr)
 		},
-		func(seq uint32, addr net.Addr, data []byte) {
-			c.recv(seq, addr, data)
-		},
-		func(seq uint32) { c.acked(seq) },
-		func(seq uint32) { c.lost(seq) },
 		30,
 	))
 
+	c.Register(c.resend)
+	c.Register(ordered.New(c.recv))
 	return c
 }
 
+// Send sends the given payload and resends it if it gets lost.
+func (c *OrderedConnection) Send(addr net.Addr, payload []byte) error {
+	return c.resend.SendReliable(addr, payload)
+}
+
 func (c *OrderedConnection) Open(port int) error {
 	err := c.Connection.Open(port)
 
@@ -54,56 +65,21 @@ func (c *OrderedConnection) Open(port int) error {
 		return err
 	}
 
-	go func() {
-		for {
-			_, _, err := c.Recv()
-
-			if err != nil {
-				return
-			}
-		}
-	}()
+	// Payloads are delivered through the ordered plugin's callback.
+	go c.Serve(context.Background(), func(net.Addr, []byte) {})
 
 	return nil
 }
 
-func (c *OrderedConnection) sent(seq uint32, addr net.Addr, data []byte) {
-	c.sendCache[seq] = &Data{addr, data}
-}
-
-func (c *OrderedConnection) recv(seq uint32, addr net.Addr, data []byte) {
-	if seq == c.sequence {
-		c.Incoming <- &Data{addr, data}
-		c.sequence++
-		return
-	}
-
-	c.recvCache[seq] = &Data{addr, data}
-
-	d, ok := c.recvCache[c.sequence]
-
-	if !ok {
-		return
-	}
-
-	delete(c.recvCache, c.sequence)
-	c.Incoming <- d
-	c.sequence++
-}
-
-func (c *OrderedConnection) acked(seq uint32) {
-	delete(c.sendCache, seq)
-}
-
-func (c *OrderedConnection) lost(seq uint32) {
-	println("lost", seq)
+// recv is called with each payload, in the order of the packet numbers.
+// Payloads which do not fit in the channel, are dropped rather than
+// holding up the connection.
+func (c *OrderedConnection) recv(addr net.Addr, data []byte) {
+	d := &Data{addr, append([]byte(nil), data...)}
 
-	data, ok := c.sendCache[seq]
-
-	if !ok {
-		return
+	select {
+	case c.Incoming <- d:
+	default:
+		log.Printf("dropped: %s", data)
 	}
-
-	delete(c.sendCache, seq)
-	c.Send(data.Addr, data.Payload)
 }